@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/karrick/tsync/saf"
+	"github.com/pkg/errors"
+)
+
+// copyPaths copies each source below the destination directory, which is the
+// last argument, the same as creating a stream of the sources and extracting
+// it in the destination, but without encoding their contents.
+func copyPaths(args []string) error {
+	if len(args) < 2 {
+		return badUsage(errors.New("cannot copy: expected at least one source and a destination"))
+	}
+	sources, dest := args[:len(args)-1], args[len(args)-1]
+
+	fi, err := os.Stat(dest)
+	if err != nil {
+		return errors.Wrap(err, "cannot copy")
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("cannot copy: destination is not a directory: %s", dest)
+	}
+	for _, source := range sources {
+		if within(dest, source) {
+			return badUsage(errors.Errorf("cannot copy: destination is inside source: %s", source))
+		}
+		if within(filepath.Join(dest, filepath.Base(source)), source) {
+			return badUsage(errors.Errorf("cannot copy: source would be copied onto itself: %s", source))
+		}
+	}
+
+	opts, err := encoderOptions()
+	if err != nil {
+		return err
+	}
+	if opts.Rewriter != nil {
+		return badUsage(errors.New("cannot copy: entries cannot be renamed"))
+	}
+	if r := newProgressReporter(); r != nil {
+		r.setTotal(saf.MeasurePaths(opts, sources...))
+		opts.Progress = r.update
+		defer r.finish()
+	}
+
+	x := saf.NewExtractor(saf.DirSink(dest), saf.ExtractorOptions{Logger: cliLogger{}})
+	c := saf.NewCopier(x, opts)
+	for _, source := range sources {
+		if err := c.AddPath(source); err != nil {
+			warning("%s: cannot copy: %+v\n", source, err)
+			entryFailed(source, err)
+		}
+	}
+	activeStats.copied(c.Stats())
+	return nil
+}
+
+// within returns true when pathname, after resolving symbolic links, is dir
+// or is below it. Paths that cannot be resolved are not within dir, because
+// they are reported when copied.
+func within(pathname, dir string) bool {
+	resolve := func(pathname string) (string, bool) {
+		abs, err := filepath.Abs(pathname)
+		if err != nil {
+			return "", false
+		}
+		abs, err = filepath.EvalSymlinks(abs)
+		return abs, err == nil
+	}
+	pathname, ok := resolve(pathname)
+	if !ok {
+		return false
+	}
+	dir, ok = resolve(dir)
+	if !ok {
+		return false
+	}
+	return pathname == dir || strings.HasPrefix(pathname, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
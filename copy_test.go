@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCopyPathsRejectsOverlap(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("src/sub", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, args := range map[string][]string{
+		"same":            {src, src},
+		"inside":          {src, filepath.Join(src, "sub")},
+		"inside, unclean": {src + "/", filepath.Join(src, "sub", "..", "sub")},
+		"inside, symlink": {src, filepath.Join(root, "link")},
+		"onto itself":     {src, root},
+	} {
+		if err := copyPaths(args); !errors.As(err, new(usageError)) {
+			t.Errorf("%s: GOT: %v; WANT: usage error", name, err)
+		}
+	}
+
+	sibling := filepath.Join(root, "srcfoo")
+	if err := os.Mkdir(sibling, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := within(sibling, src); got {
+		t.Errorf("GOT: %v; WANT: false", got)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dryRunSink is a Sink that writes how extracting each entry would change
+// the directory tree at root, without changing it. Entries are created when
+// missing, overwritten when their contents or referent differ, updated when
+// only their permissions or modification time differ, and replaced when they
+// are another type, which deletes everything below a replaced directory.
+type dryRunSink struct {
+	root string
+	w    io.Writer
+
+	// unchanged holds the entries whose contents would not change, so only
+	// their metadata is compared.
+	unchanged map[string]struct{}
+}
+
+func newDryRunSink(root string, w io.Writer) *dryRunSink {
+	return &dryRunSink{root: root, w: w, unchanged: make(map[string]struct{})}
+}
+
+func (s *dryRunSink) path(pathname string) string {
+	return filepath.Join(s.root, filepath.FromSlash(pathname))
+}
+
+// lstat returns the file system entry that would be changed, or nil when it
+// does not exist, or cannot be read.
+func (s *dryRunSink) lstat(pathname string) os.FileInfo {
+	fi, err := os.Lstat(s.path(pathname))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			debug("%s dry run: %s\n", pathname, err)
+		}
+		return nil
+	}
+	return fi
+}
+
+func (s *dryRunSink) report(action, pathname, detail string) {
+	if detail != "" {
+		_, _ = fmt.Fprintf(s.w, "%s: %s: %s\n", action, pathname, detail)
+	} else {
+		_, _ = fmt.Fprintf(s.w, "%s: %s\n", action, pathname)
+	}
+}
+
+// replace reports that the existing entry would be replaced by one of
+// another type, along with every entry below it that would be deleted.
+func (s *dryRunSink) replace(pathname string, fi os.FileInfo, mode fs.FileMode) {
+	s.report("replace-type", pathname, typeString(fi.Mode())+" with "+typeString(mode))
+	if !fi.IsDir() {
+		return
+	}
+	top := s.path(pathname)
+	_ = filepath.Walk(top, func(osPathname string, _ os.FileInfo, err error) error {
+		if err != nil {
+			warning("%s\n", err)
+			return nil
+		}
+		if osPathname != top {
+			s.report("delete", pathname+filepath.ToSlash(strings.TrimPrefix(osPathname, top)), "")
+		}
+		return nil
+	})
+}
+
+func (s *dryRunSink) Mkdir(pathname string, mode fs.FileMode) error {
+	switch fi := s.lstat(pathname); {
+	case fi == nil:
+		s.report("create", pathname, "")
+	case !fi.IsDir():
+		s.replace(pathname, fi, mode)
+	}
+	return nil
+}
+
+func (s *dryRunSink) CreateFile(pathname string, contents io.Reader) error {
+	fi := s.lstat(pathname)
+	switch {
+	case fi == nil:
+		s.report("create", pathname, "")
+	case !fi.Mode().IsRegular():
+		s.replace(pathname, fi, 0)
+	default:
+		want, err := ioutil.ReadAll(contents)
+		if err != nil {
+			return err
+		}
+		if fi.Size() == int64(len(want)) {
+			have, err := ioutil.ReadFile(s.path(pathname))
+			if err == nil && bytes.Equal(have, want) {
+				s.unchanged[pathname] = struct{}{}
+				return nil
+			}
+		}
+		s.report("overwrite", pathname, "contents differ")
+	}
+	return nil
+}
+
+func (s *dryRunSink) Symlink(linkname, pathname string) error {
+	fi := s.lstat(pathname)
+	switch {
+	case fi == nil:
+		s.report("create", pathname, "")
+	case fi.Mode()&os.ModeSymlink == 0:
+		s.replace(pathname, fi, os.ModeSymlink)
+	default:
+		if have, err := os.Readlink(s.path(pathname)); err != nil || have != linkname {
+			s.report("overwrite", pathname, "referent differs")
+		}
+	}
+	return nil
+}
+
+func (s *dryRunSink) Mkfifo(pathname string, mode fs.FileMode) error {
+	fi := s.lstat(pathname)
+	switch {
+	case fi == nil:
+		s.report("create", pathname, "")
+	case fi.Mode()&os.ModeNamedPipe == 0:
+		s.replace(pathname, fi, mode)
+	default:
+		s.unchanged[pathname] = struct{}{}
+	}
+	return nil
+}
+
+// SetMetadata reports when an entry whose contents would not change has
+// different permissions or modification time.
+func (s *dryRunSink) SetMetadata(pathname string, mode fs.FileMode, mtime time.Time) error {
+	if _, ok := s.unchanged[pathname]; !ok {
+		return nil
+	}
+	delete(s.unchanged, pathname)
+
+	fi := s.lstat(pathname)
+	if fi == nil {
+		return nil
+	}
+	var differences []string
+	if fi.Mode().Perm() != mode.Perm() {
+		differences = append(differences, fmt.Sprintf("mode %s != %s", fi.Mode().Perm(), mode.Perm()))
+	}
+	if fi.ModTime().Unix() != mtime.Unix() { // streams have whole seconds
+		differences = append(differences, fmt.Sprintf("mtime %s != %s", fi.ModTime().Format(time.RFC3339), mtime.Format(time.RFC3339)))
+	}
+	if len(differences) > 0 {
+		s.report("update", pathname, strings.Join(differences, "; "))
+	}
+	return nil
+}
+
+// Ascend reports nothing. Extraction restores the modification time of every
+// directory, so reporting each one would only repeat the changes below it.
+func (s *dryRunSink) Ascend(string, time.Time) error { return nil }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karrick/tsync/saf"
+)
+
+func TestDryRunSink(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+
+	stream := new(bytes.Buffer)
+	e, err := saf.NewEncoder(stream, saf.EncoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []struct {
+		path     string
+		mode     fs.FileMode
+		contents string
+	}{
+		{"top", fs.ModeDir | 0755, ""},
+		{"top/new", 0644, "new"},
+		{"top/same", 0644, "same"},
+		{"top/chmod", 0644, "chmod"},
+		{"top/changed", 0644, "changed"},
+		{"top/was-dir", 0644, "was-dir"},
+	} {
+		err = e.AddEntry(&saf.Entry{Path: entry.path, Mode: entry.mode, ModTime: mtime, Size: int64(len(entry.contents))}, strings.NewReader(entry.contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	for name, perm := range map[string]fs.FileMode{"same": 0644, "chmod": 0600, "changed": 0644} {
+		pathname := filepath.Join(root, "top", name)
+		if err = os.MkdirAll(filepath.Dir(pathname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		contents := name
+		if name == "changed" {
+			contents = "before"
+		}
+		if err = ioutil.WriteFile(pathname, []byte(contents), perm); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chmod(pathname, perm); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(pathname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.MkdirAll(filepath.Join(root, "top", "was-dir", "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	d, err := saf.NewDecoder(stream, saf.DecoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Decode(saf.NewExtractor(newDryRunSink(root, buf), saf.ExtractorOptions{})); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "create: top/new\n" +
+		"update: top/chmod: mode -rw------- != -rw-r--r--\n" +
+		"overwrite: top/changed: contents differ\n" +
+		"replace-type: top/was-dir: directory with file\n" +
+		"delete: top/was-dir/child\n"
+	if got := buf.String(); got != want {
+		t.Errorf("GOT:\n%sWANT:\n%s", got, want)
+	}
+
+	// Nothing was changed.
+	if _, err = os.Stat(filepath.Join(root, "top", "new")); !os.IsNotExist(err) {
+		t.Errorf("GOT: %v; WANT: not exist", err)
+	}
+}
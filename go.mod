@@ -1,12 +1,17 @@
 module github.com/karrick/tsync
 
-go 1.14
+go 1.16
 
 require (
 	github.com/OneOfOne/xxhash v1.2.8
 	github.com/karrick/gobsp v0.1.0
 	github.com/karrick/godirwalk v1.16.1
 	github.com/karrick/golf v1.4.0
+	github.com/klauspost/compress v1.11.7
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/pkg/errors v0.9.1
+	github.com/zeebo/blake3 v0.2.3
+	github.com/zeebo/xxh3 v1.0.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/sys v0.0.0-20201221093633-bc327ba9c2f0
 )
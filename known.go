@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/karrick/tsync/saf"
+	"github.com/pkg/errors"
+)
+
+// knownHashes writes the hashes of the regular files below the current
+// working directory to the output file, or to standard output, so a sender
+// given them with --known-hashes sends those files as references rather than
+// contents.
+func knownHashes() error {
+	hash, err := saf.ParseHashAlgorithm(*optHash)
+	if err != nil {
+		return badUsage(err)
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ds := saf.NewDedupSink(root, saf.DedupNone, *optDedupIndex, cliLogger{})
+	known := ds.KnownHashes(hash)
+	if err = ds.Save(); err != nil {
+		warning("%s\n", err)
+	}
+	verbose("%d known hashes\n", known.Len())
+
+	var w io.Writer = os.Stdout
+	var fh *os.File
+	if *optFile != "-" {
+		if fh, err = os.Create(*optFile); err != nil {
+			return err
+		}
+		w = fh
+	}
+	err = saf.WriteKnownHashes(w, known)
+	if fh != nil {
+		if err2 := fh.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// readKnownHashes returns the hashes written by the known-hashes sub-command
+// to the file, or to standard input when pathname is "-". They must have been
+// calculated with the hash algorithm of the stream.
+func readKnownHashes(pathname string, hash saf.HashAlgorithm) (*saf.KnownHashes, error) {
+	var r io.Reader = os.Stdin
+	if pathname != "-" {
+		fh, err := os.Open(pathname)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = fh.Close() }() // only read
+		r = fh
+	}
+	known, err := saf.ReadKnownHashes(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %q", pathname)
+	}
+	if known.Hash != hash {
+		return nil, badUsage(errors.Errorf("known hashes use %s rather than --hash %s", known.Hash, hash))
+	}
+	return known, nil
+}
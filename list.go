@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/karrick/tsync/saf"
+)
+
+// streamEntry describes a single entry decoded from the stream without
+// extracting it.
+type streamEntry struct {
+	Path     string      `json:"path"`
+	Type     string      `json:"type"`
+	Mode     os.FileMode `json:"-"`
+	Perm     string      `json:"mode"`
+	UID      uint32      `json:"uid"`
+	GID      uint32      `json:"gid"`
+	Size     int64       `json:"size"`
+	ModTime  time.Time   `json:"mtime"`
+	Hash     string      `json:"hash,omitempty"`
+	Linkname string      `json:"linkname,omitempty"`
+}
+
+// newStreamEntry returns the description of the entry, whose contents were
+// hashed with the specified algorithm.
+func newStreamEntry(entry *saf.Entry, hash saf.HashAlgorithm) *streamEntry {
+	se := &streamEntry{
+		Path:     entry.Path,
+		Type:     typeString(entry.Mode),
+		Mode:     entry.Mode,
+		UID:      entry.UID,
+		GID:      entry.GID,
+		Size:     entry.Size,
+		ModTime:  entry.ModTime,
+		Linkname: entry.Linkname,
+	}
+	switch {
+	case entry.Mode.IsDir():
+		se.Path += "/"
+	case entry.Mode.IsRegular():
+		se.Hash = fmt.Sprintf("%s:%x", hash, entry.Hash)
+	}
+	return se
+}
+
+// list prints the entries in the stream without extracting them. When the
+// archive file need not be verified, its entries are listed from its index
+// rather than reading every message.
+func list(args []string) error {
+	opts, err := decoderOptions()
+	if err != nil {
+		return err
+	}
+	r, fh, err := openInput()
+	if err != nil {
+		return err
+	}
+
+	lw := &listWriter{w: bufio.NewWriter(os.Stdout)}
+
+	d, err := saf.NewDecoder(r, opts)
+	if err == nil {
+		lw.hash = d.Header().Hash
+		if ix := d.Index(); ix != nil {
+			for i := range ix {
+				if err = lw.Visit(&ix[i].Entry, nil); err != nil {
+					break
+				}
+			}
+		} else {
+			err = d.Decode(lw)
+		}
+	}
+
+	if err2 := lw.w.Flush(); err == nil {
+		err = err2
+	}
+	if fh != nil {
+		if err2 := fh.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// listWriter is a visitor that prints each entry either as a line of JSON, or
+// as a line similar to the verbose output of tar.
+type listWriter struct {
+	w    *bufio.Writer
+	hash saf.HashAlgorithm
+}
+
+func (lw *listWriter) Visit(entry *saf.Entry, _ io.Reader) error {
+	se := newStreamEntry(entry, lw.hash)
+
+	if *optJSON {
+		se.Perm = fmt.Sprintf("%04o", se.Mode.Perm())
+		buf, err := json.Marshal(se)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, '\n')
+		_, err = lw.w.Write(buf)
+		return err
+	}
+
+	hash := se.Hash
+	if hash == "" {
+		hash = "-"
+	}
+	name := se.Path
+	if se.Linkname != "" {
+		name += " -> " + se.Linkname
+	}
+	_, err := fmt.Fprintf(lw.w, "%s %d/%d %12d %s %s %s\n", se.Mode, se.UID, se.GID, se.Size, se.ModTime.Format("2006-01-02 15:04"), hash, name)
+	return err
+}
+
+func (lw *listWriter) Ascend(*saf.Entry) error { return nil }
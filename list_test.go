@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karrick/tsync/saf"
+)
+
+// writeStream writes a stream holding the entries to a file, and returns the
+// name of the file.
+func writeStream(t *testing.T, entries []*saf.Entry, contents []string) string {
+	t.Helper()
+	stream := new(bytes.Buffer)
+	e, err := saf.NewEncoder(stream, saf.EncoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		if err = e.AddEntry(entry, strings.NewReader(contents[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pathname := filepath.Join(t.TempDir(), "stream.saf")
+	if err = ioutil.WriteFile(pathname, stream.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return pathname
+}
+
+// captureStdout returns what fn prints to standard output.
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+	fh, err := ioutil.TempFile(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	stdout := os.Stdout
+	os.Stdout = fh
+	err = fn()
+	os.Stdout = stdout
+
+	buf, err2 := ioutil.ReadFile(fh.Name())
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	return string(buf), err
+}
+
+// withOptions sets the file option, and the JSON option, for the duration of
+// the test.
+func withOptions(t *testing.T, file string, json bool) {
+	t.Helper()
+	prevFile, prevJSON := *optFile, *optJSON
+	*optFile, *optJSON = file, json
+	t.Cleanup(func() { *optFile, *optJSON = prevFile, prevJSON })
+}
+
+func TestList(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	stamp := mtime.Format("2006-01-02 15:04")
+	hash := fmt.Sprintf("%s:%x", saf.HashXXH64, saf.HashXXH64.Sum([]byte("hello")))
+
+	pathname := writeStream(t, []*saf.Entry{
+		{Path: "top", Mode: fs.ModeDir | 0755, ModTime: mtime},
+		{Path: "top/file", Mode: 0644, ModTime: mtime, Size: 5},
+	}, []string{"", "hello"})
+
+	t.Run("plain", func(t *testing.T) {
+		withOptions(t, pathname, false)
+		got, err := captureStdout(t, func() error { return list(nil) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "drwxr-xr-x 0/0            0 " + stamp + " - top/\n" +
+			"-rw-r--r-- 0/0            5 " + stamp + " " + hash + " top/file\n"
+		if got != want {
+			t.Errorf("GOT:\n%s\nWANT:\n%s", got, want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		withOptions(t, pathname, true)
+		got, err := captureStdout(t, func() error { return list(nil) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []map[string]interface{}
+		scanner := bufio.NewScanner(strings.NewReader(got))
+		for scanner.Scan() {
+			var entry map[string]interface{}
+			if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("%q: %v", scanner.Text(), err)
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("GOT: %d entries; WANT: 2", len(entries))
+		}
+		for i, want := range []map[string]interface{}{
+			{"path": "top/", "type": "directory", "mode": "0755", "size": 0.0},
+			{"path": "top/file", "type": "file", "mode": "0644", "size": 5.0, "hash": hash},
+		} {
+			for key, value := range want {
+				if got := entries[i][key]; got != value {
+					t.Errorf("%d %s: GOT: %v; WANT: %v", i, key, got, value)
+				}
+			}
+		}
+		if _, ok := entries[0]["hash"]; ok {
+			t.Errorf("GOT: %v; WANT: no hash for directory", entries[0]["hash"])
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/karrick/tsync/saf"
+	"github.com/pkg/errors"
+)
+
+var (
+	// logOutput receives debugging, verbose, warning, and error messages, and
+	// entry events when logging JSON.
+	logOutput io.Writer = os.Stderr
+
+	// logJSON is true when each message is written as a line of JSON.
+	logJSON bool
+
+	// logCommand is the sub-command included in each JSON event.
+	logCommand string
+)
+
+// setupLog configures logging from the --log-format and --log-file options.
+// The log file is appended to, so successive runs may share it.
+func setupLog(command string) error {
+	switch *optLogFormat {
+	case "text":
+	case "json":
+		logJSON = true
+	default:
+		return badUsage(errors.Errorf("cannot use log format: %q", *optLogFormat))
+	}
+	logCommand = command
+	if *optLogFile != "" {
+		fh, err := os.OpenFile(*optLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "cannot open log file")
+		}
+		logOutput = fh // closed when the process exits
+	}
+	return nil
+}
+
+// logMessage writes the message with the prefix, or when logging JSON, as a
+// message event with the level.
+func logMessage(level, prefix, format string, a ...interface{}) {
+	if logOutput == os.Stderr {
+		activeProgress.clear()
+	}
+	if !logJSON {
+		_, _ = fmt.Fprintf(logOutput, prefix+format, a...)
+		return
+	}
+	writeEvent(struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level"`
+		Event   string    `json:"event"`
+		Command string    `json:"command"`
+		Message string    `json:"message"`
+	}{
+		Time:    time.Now(),
+		Level:   level,
+		Event:   "message",
+		Command: logCommand,
+		Message: strings.TrimSuffix(fmt.Sprintf(format, a...), "\n"),
+	})
+}
+
+// entryEvent is the JSON event describing what happened to an entry.
+type entryEvent struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Event      string    `json:"event"`
+	Command    string    `json:"command"`
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Action     string    `json:"action"`
+	Size       int64     `json:"size"`
+	Duration   float64   `json:"duration_seconds"`
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"error_class,omitempty"`
+}
+
+// entryEvents returns the function that records each failed entry for the
+// failure report, and logs each entry event when logging JSON. Text logs
+// describe entries with debugging and verbose messages instead.
+func entryEvents() func(saf.Event) {
+	return func(ev saf.Event) {
+		if ev.Action == saf.ActionFailed {
+			activeStats.failed(ev.Path, ev.Err)
+		}
+		if logJSON {
+			logEntryEvent(ev)
+		}
+	}
+}
+
+func logEntryEvent(ev saf.Event) {
+	ee := entryEvent{
+		Time:     time.Now(),
+		Level:    "info",
+		Event:    "entry",
+		Command:  logCommand,
+		Path:     ev.Path,
+		Type:     typeString(ev.Mode),
+		Action:   string(ev.Action),
+		Size:     ev.Size,
+		Duration: ev.Duration.Seconds(),
+	}
+	if ev.Err != nil {
+		ee.Level = "error"
+		ee.Error = ev.Err.Error()
+		ee.ErrorClass = errorClass(ev.Err)
+	}
+	if logOutput == os.Stderr {
+		activeProgress.clear()
+	}
+	writeEvent(ee)
+}
+
+// entryFailed records that the entry could not be created or imported,
+// which was reported outside of an Encoder or Decoder.
+func entryFailed(pathname string, err error) {
+	entryEvents()(saf.Event{Path: pathname, Mode: fs.ModeIrregular, Action: saf.ActionFailed, Err: err})
+}
+
+// errorClass returns the class of the error, so failures of a particular
+// kind may be found without matching error messages.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, saf.ErrHashMismatch):
+		return "hash_mismatch"
+	case errors.Is(err, saf.ErrContentsNotSent):
+		return "not_sent"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not_exist"
+	case errors.Is(err, fs.ErrExist):
+		return "exist"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "truncated"
+	}
+	return "other"
+}
+
+// writeEvent writes the event as a line of JSON.
+func writeEvent(event interface{}) {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "[ERROR] cannot encode log event: %s\n", err)
+		return
+	}
+	_, _ = logOutput.Write(append(buf, '\n'))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/karrick/tsync/saf"
+	"github.com/pkg/errors"
+)
+
+func TestErrorClass(t *testing.T) {
+	_, errNotExist := os.Open("/does/not/exist")
+
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{errors.Wrap(saf.ErrHashMismatch, "xxhash64"), "hash_mismatch"},
+		{errors.Wrap(saf.ErrContentsNotSent, "cannot find contents in destination"), "not_sent"},
+		{errors.Wrap(errNotExist, "cannot encode"), "not_exist"},
+		{&fs.PathError{Op: "open", Path: "x", Err: fs.ErrPermission}, "permission"},
+		{errors.New("something else"), "other"},
+	} {
+		if got := errorClass(tc.err); got != tc.want {
+			t.Errorf("%v: GOT: %q; WANT: %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestBadUsage(t *testing.T) {
+	if badUsage(nil) != nil {
+		t.Errorf("GOT: error; WANT: nil")
+	}
+	err := errors.Wrap(badUsage(errors.New("bad flag")), "cannot create")
+	if !errors.As(err, new(usageError)) {
+		t.Errorf("GOT: %v; WANT: usage error", err)
+	}
+}
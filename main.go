@@ -2,46 +2,59 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
-	"time"
+	"strings"
 
-	"github.com/OneOfOne/xxhash"
-	"github.com/karrick/gobsp"
-	"github.com/karrick/godirwalk"
 	"github.com/karrick/golf"
+	"github.com/karrick/tsync/saf"
 	"github.com/pkg/errors"
 )
 
-var dirReadScratch = make([]byte, 64*1024)
-var fileScratch *bytes.Buffer
-var messageScratch *bytes.Buffer
-
-func init() {
-	fileScratch = bytes.NewBuffer(make([]byte, 1*1024*1024))
-	messageScratch = bytes.NewBuffer(make([]byte, 1*1024*1024))
-}
-
-const (
-	v1Syn              gobsp.MessageType = iota // 0 client opens connection with protocol version request
-	v1SynAck                                    // 1 server responds with protocol version selection
-	v1RegularFile                               // 2
-	v1DirectoryDescend                          // 3
-	v1DirectoryAscend                           // 4
-	v1Symlink                                   // 5
-	v1FIFO                                      // 6
-	v1Socket                                    // 7
-	v1Device                                    // 8
-)
-
 var (
-	optChdir   = golf.String("chdir", "", "when extracting, change to this directory prior to extraction")
-	optDebug   = golf.Bool("debug", false, "prints debugging when true")
-	optFile    = golf.String("file", "-", "name of input or output file; - means stdin or stdout")
-	optVerbose = golf.Bool("verbose", false, "prints verbose information to stderr")
+	optChdir       = golf.String("chdir", "", "when extracting, change to this directory prior to extraction")
+	optCompress    = golf.String("compress", "none", "when creating, compress file contents with gzip, lz4, zstd, or none")
+	optDebug       = golf.Bool("debug", false, "prints debugging when true")
+	optDedup       = golf.String("dedup", "none", "when extracting, create files already in the destination with the same hash by reflink, link, or none")
+	optDedupIndex  = golf.String("dedup-index", "", "when extracting with --dedup, or writing known hashes, keep the hashes of destination files in this file")
+	optDryRun      = golf.Bool("dry-run", false, "when extracting, print the changes extraction would make without making them")
+	optFile        = golf.String("file", "-", "name of input or output file; - means stdin or stdout")
+	optHash        = golf.String("hash", "xxhash64", "when creating, verify file contents with xxhash64, xxh3-128, sha256, or blake3")
+	optJSON        = golf.Bool("json", false, "when listing, print each entry as a line of JSON")
+	optKnownHashes = golf.String("known-hashes", "", "when creating, send files whose hashes the destination has, read from this file written by known-hashes, as references rather than contents")
+	optLogFile     = golf.String("log-file", "", "append messages to this file rather than stderr")
+	optLogFormat   = golf.String("log-format", "text", "write messages as text, or as json events including one event per entry")
+	optProgress    = golf.Bool("progress", false, "when creating, copying, or extracting, prints progress to stderr")
+	optStatsFile   = golf.String("stats-file", "", "when creating, copying, or extracting, write statistics of the run as JSON to this file")
+	optVerbose     = golf.Bool("verbose", false, "prints verbose information and progress to stderr")
+
+	optExclude     = golf.String("exclude", "", "comma separated glob patterns of entries to skip")
+	optExcludeFrom = golf.String("exclude-from", "", "when creating, read include and exclude rules from this file")
+	optInclude     = golf.String("include", "", "comma separated glob patterns of entries to select")
+
+	optOneFileSystem = golf.Bool("one-file-system", false, "when creating, do not encode contents of directories on other file systems")
+	optSkipFstypes   = golf.String("skip-fstypes", "", "when creating, comma separated file system types whose contents are not encoded, e.g., proc,sysfs,tmpfs,nfs")
+
+	optCopyUnsafeLinks = golf.Bool("copy-unsafe-links", false, "when creating, encode referent of symlinks pointing outside of target rather than symlink")
+	optDereference     = golf.Bool("dereference", false, "when creating, encode referent of every symlink rather than symlink")
+	optDereferenceArgs = golf.Bool("dereference-args", false, "when creating, encode referent of symlinks named as targets rather than symlink")
+
+	optAs              = golf.String("as", "", "rename top-level entries to this name")
+	optStripComponents = golf.Int("strip-components", 0, "remove this many leading components from entry names")
+	optTransform       = golf.String("transform", "", "rename entries using semicolon separated sed style substitutions, e.g., s/old/new/")
+
+	optKeyFile        = golf.String("key-file", "", "encrypt or decrypt stream using key derived from contents of this file")
+	optPassphraseFile = golf.String("passphrase-file", "", "encrypt or decrypt stream using key derived from first line of this file")
+
+	optSignKey       = golf.String("sign-key", "", "when creating, sign stream with Ed25519 private key from this PEM file")
+	optSignatureFile = golf.String("signature-file", "", "write or read detached signature in this file rather than in stream")
+	optStrictVerify  = golf.Bool("strict-verify", false, "when extracting, verify entire stream before extracting any entries")
+	optVerifyKey     = golf.String("verify-key", "", "when extracting, only commit entries when stream signed by Ed25519 public key from this PEM file; directories are still created before the signature is verified unless --strict-verify")
 )
 
 func main() {
@@ -53,692 +66,568 @@ func main() {
 	}
 
 	cmd, args := args[0], args[1:]
+	fatalWhenErr(setupLog(cmd))
 
 	if *optChdir != "" {
 		// Convert arguments to absolute so we can find them after changing
-		// directories.
+		// directories. Arguments to other sub-commands name entries in the
+		// stream rather than file system entries.
 		var err error
-		for i := 0; i < len(args); i++ {
-			args[i], err = filepath.Abs(args[i])
-			fatalWhenErr(err)
+		if cmd == "create" || cmd == "copy" {
+			for i := 0; i < len(args); i++ {
+				args[i], err = filepath.Abs(args[i])
+				fatalWhenErr(err)
+			}
+		}
+		for _, opt := range []*string{optFile, optDedupIndex, optExcludeFrom, optKnownHashes, optKeyFile, optPassphraseFile, optSignKey, optSignatureFile, optStatsFile, optVerifyKey} {
+			if *opt != "" && *opt != "-" {
+				*opt, err = filepath.Abs(*opt)
+				fatalWhenErr(err)
+			}
 		}
 		fatalWhenErr(os.Chdir(*optChdir))
 	}
 
 	switch cmd {
+	case "copy":
+		run(cmd, func() error { return copyPaths(args) })
 	case "create":
-		fatalWhenErr(create(args))
+		run(cmd, func() error { return create(args) })
+	case "export-tar":
+		fatalWhenErr(exportTar())
 	case "extract":
-		fatalWhenErr(extract(args))
+		run(cmd, func() error { return extract(args) })
+	case "import-tar":
+		run(cmd, importTar)
+	case "known-hashes":
+		fatalWhenErr(knownHashes())
+	case "list":
+		fatalWhenErr(list(args))
+	case "verify":
+		fatalWhenErr(verify(args))
 	default:
 		usage(fmt.Sprintf("invalid sub-command: %q", cmd))
 	}
 }
 
+// Exit codes, which allow scripts to tell a run that did everything from one
+// that did some of it, and from one that could not finish.
+const (
+	exitFatal   = 1 // the stream could not be created, read, or verified
+	exitUsage   = 2 // the command line is invalid
+	exitPartial = 3 // finished, but some entries could not be created or extracted
+)
+
+// run invokes fn to create or extract a stream, reporting the statistics and
+// failures when it finishes, and exits with exitPartial when some entries
+// failed.
+func run(cmd string, fn func() error) {
+	rs := startStats(cmd)
+	err := fn()
+	if errors.As(err, new(usageError)) {
+		fatalWhenErr(err) // nothing was done
+	}
+	fatalWhenErr(rs.finish(err))
+	if rs.Errors > 0 {
+		os.Exit(exitPartial)
+	}
+}
+
 func usage(message string) {
 	exec := filepath.Base(os.Args[0])
 	fmt.Fprintf(os.Stderr, "%s\n", message)
-	fmt.Fprintf(os.Stderr, "usage: %s [--debug | --verbose] [--file -] create arg1 arg2...\n", exec)
-	fmt.Fprintf(os.Stderr, "usage: %s [--chdir PATH] [--debug | --verbose] [--file -] [--chdir PATH] extract\n", exec)
-	os.Exit(2)
+	fmt.Fprintf(os.Stderr, "usage: %s [--debug | --verbose] [--log-format text] [--log-file FILE] [--progress] [--stats-file FILE] [--file -] [--compress none] [--hash xxhash64] [--key-file FILE | --passphrase-file FILE] [--sign-key FILE [--signature-file FILE]] [--known-hashes FILE] [--include PATTERNS] [--exclude PATTERNS] [--exclude-from FILE] [--one-file-system] [--skip-fstypes TYPES] [--dereference | --dereference-args | --copy-unsafe-links] [--strip-components N] [--transform EXPR] [--as NAME] create arg1 arg2...\n", exec)
+	fmt.Fprintf(os.Stderr, "usage: %s [--chdir PATH] [--debug | --verbose] [--log-format text] [--log-file FILE] [--progress] [--stats-file FILE] [--include PATTERNS] [--exclude PATTERNS] [--exclude-from FILE] [--one-file-system] [--skip-fstypes TYPES] [--dereference | --dereference-args | --copy-unsafe-links] copy src1 src2... dest\n", exec)
+	fmt.Fprintf(os.Stderr, "usage: %s [--chdir PATH] [--debug | --verbose] [--log-format text] [--log-file FILE] [--progress] [--stats-file FILE] [--file -] [--key-file FILE | --passphrase-file FILE] [--verify-key FILE [--signature-file FILE] [--strict-verify]] [--include PATTERNS] [--exclude PATTERNS] [--strip-components N] [--transform EXPR] [--as NAME] [--dedup none [--dedup-index FILE]] [--dry-run] extract [path1 path2...]\n", exec)
+	fmt.Fprintf(os.Stderr, "usage: %s [--debug | --verbose] [--log-format text] [--log-file FILE] [--progress] [--stats-file FILE] [--file -] [--compress none] [--hash xxhash64] [--key-file FILE | --passphrase-file FILE] [--sign-key FILE [--signature-file FILE]] [--strip-components N] [--transform EXPR] [--as NAME] import-tar < archive.tar\n", exec)
+	fmt.Fprintf(os.Stderr, "usage: %s [--file -] [--key-file FILE | --passphrase-file FILE] [--verify-key FILE [--signature-file FILE]] export-tar > archive.tar\n", exec)
+	fmt.Fprintf(os.Stderr, "usage: %s [--chdir PATH] [--debug | --verbose] [--file -] [--hash xxhash64] [--dedup-index FILE] known-hashes > known\n", exec)
+	fmt.Fprintf(os.Stderr, "usage: %s [--file -] [--json] [--key-file FILE | --passphrase-file FILE] [--verify-key FILE [--signature-file FILE]] list\n", exec)
+	fmt.Fprintf(os.Stderr, "usage: %s [--chdir PATH] [--file -] [--key-file FILE | --passphrase-file FILE] [--verify-key FILE [--signature-file FILE]] verify\n", exec)
+	os.Exit(exitUsage)
 }
 
 // fatalWhenErr displays the error message and exits if err is not nil. When err is
 // nil, it returns.
 func fatalWhenErr(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[ERROR] %s\n", err)
-		os.Exit(1)
+		logMessage("error", "[ERROR] ", "%s\n", err)
+		if errors.As(err, new(usageError)) {
+			os.Exit(exitUsage)
+		}
+		os.Exit(exitFatal)
+	}
+}
+
+// usageError is an error caused by the command line rather than the stream.
+type usageError struct{ error }
+
+func (ue usageError) Unwrap() error { return ue.error }
+
+// badUsage returns err marked as caused by the command line, or nil when err
+// is nil.
+func badUsage(err error) error {
+	if err == nil {
+		return nil
 	}
+	return usageError{err}
 }
 
 func debug(format string, a ...interface{}) {
 	if *optDebug {
-		_, _ = fmt.Fprintf(os.Stderr, "[DEBUG] "+format, a...)
+		logMessage("debug", "[DEBUG] ", format, a...)
+	}
+}
+
+func verbose(format string, a ...interface{}) {
+	if *optVerbose {
+		logMessage("verbose", "", format, a...)
 	}
 }
 
 func warning(format string, a ...interface{}) {
-	_, _ = fmt.Fprintf(os.Stderr, "[WARNING] "+format, a...)
+	warnings++
+	logMessage("warning", "[WARNING] ", format, a...)
 }
 
-func create(args []string) error {
-	var err error
-	var fh *os.File
-	var composer *gobsp.Composer
+// cliLogger reports the debugging, verbose, and warning messages of the saf
+// package according to the command line options.
+type cliLogger struct{}
 
-	if *optFile == "-" {
-		composer = gobsp.NewComposer(os.Stdout)
-	} else {
-		fh, err = os.Create(*optFile)
-		if err != nil {
-			return err
-		}
-		composer = gobsp.NewComposer(fh)
-	}
+func (cliLogger) Debugf(format string, a ...interface{})   { debug(format, a...) }
+func (cliLogger) Verbosef(format string, a ...interface{}) { verbose(format, a...) }
+func (cliLogger) Warningf(format string, a ...interface{}) { warning(format, a...) }
 
-	for _, arg := range args {
-		if err := encodeTarget(composer, arg); err != nil {
-			warning("%s: cannot encode: %+v\n", arg, err)
+// splitPatterns returns the comma separated glob patterns in value.
+func splitPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
 		}
 	}
+	return patterns
+}
 
-	// Flush the composer's buffer, and close file handle when open.
-	err = composer.Close()
-	if fh != nil {
-		if err2 := fh.Close(); err == nil {
-			err = err2
+// filterFlags returns the names of the include, exclude, and exclude-from
+// flags in the order they appear in args, so their rules are tested in the
+// order they were given. Because only the last value of a flag is used, a
+// flag given more than once takes the place of its last occurrence.
+func filterFlags(args []string) []string {
+	var names []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			break
+		}
+		var name string
+		switch args[i] {
+		case "--include", "--exclude", "--exclude-from":
+			name = args[i][2:]
+		default:
+			continue
+		}
+		for j, other := range names {
+			if other == name {
+				names = append(names[:j], names[j+1:]...)
+				break
+			}
 		}
+		names = append(names, name)
+		i++ // skip the value of the flag
 	}
-	return err
+	return names
 }
 
-func extract(args []string) error {
-	var err error
-	var fh *os.File
-	var r io.Reader
-
-	if *optFile == "-" {
-		r = os.Stdin
-	} else {
-		fh, err = os.Open(*optFile)
+// secretFromOptions returns the secret from the key file or passphrase file,
+// or nil when the stream is not encrypted.
+func secretFromOptions() (*saf.Secret, error) {
+	if *optKeyFile != "" && *optPassphraseFile != "" {
+		return nil, badUsage(errors.New("cannot use both --key-file and --passphrase-file"))
+	}
+	if *optKeyFile != "" {
+		buf, err := ioutil.ReadFile(*optKeyFile)
 		if err != nil {
-			return err
-		}
-		r = fh
-	}
-
-	scanner, err := gobsp.NewScanner(r, gobsp.Handlers(map[uint32]gobsp.MessageHandler{
-		uint32(v1RegularFile):      decodeFile,
-		uint32(v1DirectoryAscend):  decodeDirectoryAscend,
-		uint32(v1DirectoryDescend): decodeDirectoryDescend,
-		uint32(v1Symlink):          decodeSymlink,
-		uint32(v1FIFO):             decodeFIFO,
-		uint32(v1Socket):           decodeSocket,
-		uint32(v1Device):           decodeDevice,
-	}))
-	if err != nil {
-		if fh != nil {
-			_ = fh.Close() // ignore secondary error
+			return nil, errors.Wrap(err, "cannot read key file")
 		}
-		return err
+		return saf.NewKeySecret(buf)
 	}
-
-	for scanner.Scan() {
-		if err = scanner.Handle(); err != nil {
-			warning("%s\n", err)
+	if *optPassphraseFile != "" {
+		buf, err := ioutil.ReadFile(*optPassphraseFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read passphrase file")
 		}
-	}
-
-	if err2 := scanner.Err(); err == nil {
-		err = err2
-	}
-
-	if fh != nil {
-		if err2 := fh.Close(); err == nil {
-			err = err2
+		// Only the first line is the passphrase, which allows the file to be
+		// created with echo.
+		if i := bytes.IndexAny(buf, "\r\n"); i >= 0 {
+			buf = buf[:i]
 		}
+		return saf.NewPassphraseSecret(buf)
 	}
-
-	return err
+	return nil, nil
 }
 
-func encodeTarget(composer *gobsp.Composer, target string) error {
-	var err error
-	target, err = filepath.Abs(target)
+func create(args []string) error {
+	opts, err := encoderOptions()
 	if err != nil {
 		return err
 	}
-	de, err := godirwalk.NewDirent(target)
-	if err != nil {
-		return errors.Wrap(err, "cannot encode")
-	}
-	return encodeDirent(composer, filepath.Dir(target), de)
-}
-
-func encodeDirent(composer *gobsp.Composer, targetParent string, de *godirwalk.Dirent) error {
-	if de.IsRegular() {
-		return errors.Wrap(encodeFile(composer, targetParent, de.Name()), "cannot encode file")
-	} else if de.IsDir() {
-		return errors.Wrap(encodeDirectory(composer, targetParent, de.Name()), "cannot encode directory")
-	} else if de.IsSymlink() {
-		return errors.Wrap(encodeSymlink(composer, targetParent, de.Name()), "cannot encode symlink")
-	} else if de.ModeType()&os.ModeNamedPipe != 0 {
-		return errors.Wrap(encodeFIFO(composer, targetParent, de.Name()), "cannot encode FIFO")
-	} else if de.ModeType()&os.ModeSocket != 0 {
-		return errors.Wrap(encodeSocket(composer, targetParent, de.Name()), "cannot encode socket")
-	} else if de.ModeType()&os.ModeDevice != 0 {
-		// TODO: add support
-	}
-	return errors.Errorf("cannot encode item: file mode type not supported: %s", de.ModeType())
+	if r := newProgressReporter(); r != nil {
+		// Walking the targets twice is cheap compared to reading every file,
+		// and allows the remaining time to be estimated.
+		r.setTotal(saf.MeasurePaths(opts, args...))
+		opts.Progress = r.update
+		defer r.finish()
+	}
+	return createStream(opts, func(e *saf.Encoder) error {
+		for _, arg := range args {
+			if err := e.AddPath(arg); err != nil {
+				warning("%s: cannot encode: %+v\n", arg, err)
+				entryFailed(arg, err)
+			}
+		}
+		return nil
+	})
 }
 
-// encodeDirectory encodes directory to composer, including all the children of
-// the directory. If something prevents encoding directory, then return
-// early. When one of the children of the directory fails to encode, emit a
-// warning message, but continue on to the other children.
-func encodeDirectory(composer *gobsp.Composer, targetParent, targetBase string) error {
-	targetFull := filepath.Join(targetParent, targetBase)
-	debug("%s encode directory\n", targetFull)
-
-	fi, err := os.Stat(targetFull)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	deChildren, err := godirwalk.ReadDirents(targetFull, dirReadScratch)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	if err = encodeDirectoryDescend(composer, fi); err != nil {
-		return errors.WithStack(err)
-	}
-
-	// Only sort the children when want debugging because it takes time but is
-	// not necessary.
-	if *optDebug {
-		sort.Sort(deChildren) // DEBUG for sorted order
-	}
-
-	for _, deChild := range deChildren {
-		if err = encodeDirent(composer, targetFull, deChild); err != nil {
-			warning("%s: %+s\n", filepath.Join(targetFull, deChild.Name()), err)
+// encoderOptions returns the options for writing a stream from the
+// compression, hash, encryption, signing, and create options.
+func encoderOptions() (saf.EncoderOptions, error) {
+	var err error
+	opts := saf.EncoderOptions{
+		DetachSignature: *optSignatureFile != "",
+		OneFileSystem:   *optOneFileSystem,
+		SkipFstypes:     splitPatterns(*optSkipFstypes),
+		Events:          entryEvents(),
+		Sorted:          *optDebug, // takes time but is not necessary
+		Logger:          cliLogger{},
+	}
+	if opts.Codec, err = saf.ParseCodec(*optCompress); err != nil {
+		return opts, badUsage(err)
+	}
+	if opts.Hash, err = saf.ParseHashAlgorithm(*optHash); err != nil {
+		return opts, badUsage(err)
+	}
+	if opts.Secret, err = secretFromOptions(); err != nil {
+		return opts, err
+	}
+	if *optSignKey != "" {
+		if opts.SignKey, err = readSignKey(*optSignKey); err != nil {
+			return opts, err
 		}
 	}
-
-	// When leaving a directory, send its modification time to remote.  There is
-	// no error recovery for this not working, because local and remote will be
-	// in different directories.
-	fatalWhenErr(encodeDirectoryAscend(composer, fi))
-
-	return nil
-}
-
-func encodeDirectoryAscend(composer *gobsp.Composer, fi os.FileInfo) error {
-	messageScratch.Reset()
-	if err := gobsp.Int64(fi.ModTime().Unix()).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode modification time")
+	if *optKnownHashes != "" {
+		if opts.KnownHashes, err = readKnownHashes(*optKnownHashes, opts.Hash); err != nil {
+			return opts, err
+		}
 	}
-	return composer.Compose(v1DirectoryAscend, messageScratch.Bytes())
-}
-
-func encodeDirectoryDescend(composer *gobsp.Composer, fi os.FileInfo) error {
-	messageScratch.Reset()
-	if err := gobsp.String(fi.Name()).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrapf(err, "cannot encode name")
+	if opts.Rewriter, err = saf.NewRewriter(*optStripComponents, *optAs, *optTransform); err != nil {
+		return opts, badUsage(err)
+	}
+	opts.Filter = new(saf.Filter)
+	for _, name := range filterFlags(os.Args[1:]) {
+		switch name {
+		case "include":
+			opts.Filter.Include(splitPatterns(*optInclude)...)
+		case "exclude":
+			opts.Filter.Exclude(splitPatterns(*optExclude)...)
+		case "exclude-from":
+			if *optExcludeFrom != "" {
+				if err = opts.Filter.ReadExcludeFrom(*optExcludeFrom); err != nil {
+					return opts, err
+				}
+			}
+		}
 	}
-	if err := gobsp.Uint32(fi.Mode()).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrapf(err, "cannot encode mode")
+	switch {
+	case *optDereference:
+		opts.Dereference = saf.DereferenceAll
+	case *optDereferenceArgs:
+		opts.Dereference = saf.DereferenceArgs
+	case *optCopyUnsafeLinks:
+		opts.Dereference = saf.DereferenceUnsafe
 	}
-	return composer.Compose(v1DirectoryDescend, messageScratch.Bytes())
+	return opts, nil
 }
 
-func encodeFile(composer *gobsp.Composer, targetParent, targetBase string) error {
-	targetFull := filepath.Join(targetParent, targetBase)
-	debug("%s encode file\n", targetFull)
-
-	fh, err := os.Open(targetFull)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	fi, err := fh.Stat()
-	if err != nil {
-		_ = fh.Close() // ignore secondary error
-		return errors.WithStack(err)
-	}
-
-	size := fi.Size()
-	fileScratch.Reset()
-	fileScratch.Grow(int(size))
-
-	c, err := fileScratch.ReadFrom(fh)
-	if err2 := fh.Close(); err == nil {
-		err = err2
-	}
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if c < size {
-		return errors.Wrapf(io.ErrUnexpectedEOF, "read fewer than expected bytes: %d < %d", c, size)
-	}
-
-	h := xxhash.New64()
-	_, err = h.Write(fileScratch.Bytes())
-	if err != nil {
-		// While hash ought never return error, should protect against a
-		// misbehaving hash if someday which library is changed.
-		return errors.Wrap(err, "cannot calculate hash")
-	}
-
-	messageScratch.Reset()
+// createStream writes a stream with the specified options to the output
+// file, or to standard output, and invokes add to add its entries. An
+// unencrypted output file also has an index of its entries.
+func createStream(opts saf.EncoderOptions, add func(*saf.Encoder) error) error {
+	var err error
+	var fh *os.File
+	var w io.Writer
 
-	if err = gobsp.String(targetBase).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode name")
+	if *optFile == "-" {
+		w = os.Stdout
+	} else {
+		fh, err = os.Create(*optFile)
+		if err != nil {
+			return err
+		}
+		w = fh
 	}
-
-	debug("%s mtime: %v\n", targetBase, fi.ModTime().UTC().Unix())
-	if err = gobsp.Int64(fi.ModTime().UTC().Unix()).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode modification time")
+	if activeStats != nil {
+		w = &countingWriter{w: w, rs: activeStats}
 	}
 
-	debug("%s mode: %v\n", targetBase, fi.Mode())
-	if err = gobsp.Uint32(uint32(fi.Mode())).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode mode")
-	}
+	// Only archive files may be read at random, so only they have an index.
+	opts.Index = fh != nil
 
-	debug("%s hash: % x\n", targetBase, h.Sum64())
-	if err = gobsp.Uint64(h.Sum64()).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode hash")
+	e, err := saf.NewEncoder(w, opts)
+	if err == nil {
+		err = add(e)
+		if err2 := e.Close(); err == nil {
+			err = err2
+		}
+		activeStats.encoded(e.Stats())
 	}
-
-	if err = gobsp.UVWI(size).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode size")
+	if fh != nil {
+		if err2 := fh.Close(); err == nil {
+			err = err2
+		}
 	}
-
-	messageScratch.Grow(int(size))
-	if _, err = fileScratch.WriteTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode contents")
+	if err == nil && opts.DetachSignature && opts.SignKey != nil {
+		encoded := base64.StdEncoding.EncodeToString(e.Signature()) + "\n"
+		err = errors.Wrap(ioutil.WriteFile(*optSignatureFile, []byte(encoded), 0644), "cannot write signature file")
 	}
-
-	return composer.Compose(v1RegularFile, messageScratch.Bytes())
+	return err
 }
 
-func encodeSymlink(composer *gobsp.Composer, targetParent, targetBase string) error {
-	targetFull := filepath.Join(targetParent, targetBase)
-	debug("%s encode symlink\n", targetFull)
-	debug("%s targetParent: %s\n", targetBase, targetParent)
-
-	li, err := os.Lstat(string(targetFull))
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	linkname, err := os.Readlink(targetFull)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	messageScratch.Reset()
-
-	// name
-	if err = gobsp.String(targetBase).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode name")
-	}
-
-	debug("%s referent: %v\n", targetBase, linkname)
-	if err = gobsp.String(linkname).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode referent")
-	}
-
-	mtime := li.ModTime().UTC().Unix()
-	debug("%s mtime: %v\n", targetBase, mtime)
-	if err = gobsp.Int64(mtime).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode modification time")
-	}
-
-	mode := li.Mode()
-	debug("%s mode: %v\n", targetBase, mode)
-	if err = gobsp.Uint32(uint32(li.Mode())).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode mode")
+// openInput returns the stream named by the --file option, along with its
+// file handle when it is not standard input, which the caller must close.
+func openInput() (io.Reader, *os.File, error) {
+	if *optFile == "-" {
+		return countInput(os.Stdin), nil, nil
 	}
-
-	return composer.Compose(v1Symlink, messageScratch.Bytes())
-}
-
-func encodeFIFO(composer *gobsp.Composer, targetParent, targetBase string) error {
-	targetFull := filepath.Join(targetParent, targetBase)
-	debug("%s encode fifo\n", targetFull)
-
-	fi, err := os.Stat(targetFull)
+	fh, err := os.Open(*optFile)
 	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	messageScratch.Reset()
-
-	if err = gobsp.String(targetBase).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode name")
-	}
-
-	debug("%s mtime: %v\n", targetBase, fi.ModTime().UTC().Unix())
-	if err = gobsp.Int64(fi.ModTime().UTC().Unix()).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode modification time")
-	}
-
-	debug("%s mode: %v\n", targetBase, fi.Mode())
-	if err = gobsp.Uint32(uint32(fi.Mode())).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode mode")
+		return nil, nil, err
 	}
-
-	return composer.Compose(v1FIFO, messageScratch.Bytes())
+	return countInput(fh), fh, nil
 }
 
-func encodeSocket(composer *gobsp.Composer, targetParent, targetBase string) error {
-	targetFull := filepath.Join(targetParent, targetBase)
-	debug("%s encode socket\n", targetFull)
-
-	fi, err := os.Stat(targetFull)
-	if err != nil {
-		return errors.Wrap(err, "cannot encode socket")
+// countInput returns fh, which counts the bytes read from it when the
+// statistics of the run are being accumulated.
+func countInput(fh *os.File) io.Reader {
+	if activeStats == nil {
+		return fh
 	}
-
-	messageScratch.Reset()
-
-	// name
-	if err = gobsp.String(targetBase).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode socket name")
-	}
-	// mtime
-	debug("%s mtime: %v\n", targetBase, fi.ModTime().UTC().Unix())
-	if err = gobsp.Int64(fi.ModTime().UTC().Unix()).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode socket modification time")
-	}
-	// mode
-	debug("%s mode: %v\n", targetBase, fi.Mode())
-	if err = gobsp.Uint32(uint32(fi.Mode())).MarshalBinaryTo(messageScratch); err != nil {
-		return errors.Wrap(err, "cannot encode socket mode")
-	}
-
-	return errors.Wrap(composer.Compose(v1Socket, messageScratch.Bytes()), "cannot encode socket")
+	return &countingFile{f: fh, rs: activeStats}
 }
 
-func decodeDevice(r io.Reader) error {
+// decoderOptions returns the options for reading a stream, including the
+// secret to decrypt it, and when asked to verify the stream, the key and the
+// detached signature.
+func decoderOptions() (saf.DecoderOptions, error) {
 	var err error
-	var targetBase gobsp.String
+	opts := saf.DecoderOptions{Logger: cliLogger{}}
 
-	if err = targetBase.UnmarshalBinaryFrom(r); err != nil {
-		return err
+	if opts.Secret, err = secretFromOptions(); err != nil {
+		return opts, err
 	}
-	debug("%s decode device\n", targetBase)
-	return errors.Errorf("%s decode device not implemented", targetBase)
-}
-
-func decodeDirectoryAscend(r io.Reader) error {
-	var mtime gobsp.Int64
-	if err := mtime.UnmarshalBinaryFrom(r); err != nil {
-		return err
+	if *optVerifyKey == "" {
+		return opts, nil
 	}
-
-	wd, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-
-	t := time.Unix(int64(mtime), 0)
-	if err = os.Chtimes(wd, t, t); err != nil {
-		return err
+	if opts.VerifyKey, err = readVerifyKey(*optVerifyKey); err != nil {
+		return opts, err
 	}
-
-	return os.Chdir(filepath.Dir(wd))
-}
-
-func decodeDirectoryDescend(r io.Reader) error {
-	var targetBase gobsp.String
-	fatalWhenErr(targetBase.UnmarshalBinaryFrom(r))
-	debug("%s decode directory\n", targetBase)
-
-	var mode gobsp.Uint32
-	fatalWhenErr(mode.UnmarshalBinaryFrom(r))
-
-	// Use Lstat to check whether file system object currently with same name
-	// exists and is not a directory.
-	fi, err := os.Lstat(string(targetBase))
-	if err != nil {
-		if !os.IsNotExist(err) {
-			fatalWhenErr(err) // unknown error
-		}
-		// targetBase does not exist; create a directory and descend. Use less
-		// restrictive os.ModePerm for initial permissions, and will tighten
-		// down when we leave this directory.
-		fatalWhenErr(os.Mkdir(string(targetBase), os.FileMode(mode)))
-		fatalWhenErr(os.Chdir(string(targetBase)))
-	} else {
-		// targetBase exists
-		if fi.IsDir() {
-			// targetBase already directory, so ensure permissions allow then descend
-			fatalWhenErr(os.Chdir(string(targetBase)))
-		} else {
-			// targetBase not directory, but should be
-			fatalWhenErr(os.Remove(string(targetBase)))
-			fatalWhenErr(os.Mkdir(string(targetBase), os.FileMode(mode)))
-			fatalWhenErr(os.Chdir(string(targetBase)))
+	if *optSignatureFile != "" {
+		if opts.Signature, err = readSignatureFile(*optSignatureFile); err != nil {
+			return opts, err
 		}
 	}
-	return nil
+	return opts, nil
 }
 
-func decodeFIFO(r io.Reader) error {
-	var err error
-	var targetBase gobsp.String
-	var mtime gobsp.Int64
-	var mode gobsp.Uint32
-
-	if err = targetBase.UnmarshalBinaryFrom(r); err != nil {
-		return err
-	}
-	debug("%s decode fifo\n", targetBase)
-
-	if err = mtime.UnmarshalBinaryFrom(r); err != nil {
+// decodeInput decodes the stream named by the --file option with v.
+func decodeInput(opts saf.DecoderOptions, v func(*saf.Decoder) saf.Visitor) error {
+	r, fh, err := openInput()
+	if err != nil {
 		return err
 	}
-
-	if err = mode.UnmarshalBinaryFrom(r); err != nil {
-		return err
+	d, err := saf.NewDecoder(r, opts)
+	if err == nil {
+		err = d.Decode(v(d))
+		activeStats.decoded(d.Stats())
 	}
-
-	// When exists, but wrong type...
-	fi, err := os.Lstat(string(targetBase))
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return errors.WithStack(err)
-		}
-	} else if fi.Mode()&os.ModeNamedPipe == 0 {
-		if err = os.RemoveAll(string(targetBase)); err != nil {
-			return errors.WithStack(err)
+	if fh != nil {
+		if err2 := fh.Close(); err == nil {
+			err = err2
 		}
 	}
-
-	return makeFIFO(string(targetBase), uint32(mode), time.Unix(int64(mtime), 0))
+	return err
 }
 
-func decodeFile(r io.Reader) error {
-	var err error
-	var targetBase gobsp.String
-	var mtime gobsp.Int64
-	var mode gobsp.Uint32
-	var hashSource gobsp.Uint64
-	var size gobsp.UVWI
-
-	if err = targetBase.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode name")
-	}
-	debug("%s decode file\n", targetBase)
-
-	if err = mtime.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode modification time")
-	}
-
-	if err = mode.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode mode")
+func extract(args []string) error {
+	opts, err := decoderOptions()
+	if err != nil {
+		return err
 	}
-
-	if err = hashSource.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode hash")
+	if opts.Rewriter, err = saf.NewRewriter(*optStripComponents, *optAs, *optTransform); err != nil {
+		return badUsage(err)
 	}
-
-	if err = size.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode size")
+	if s := saf.NewSelection(args, splitPatterns(*optInclude), splitPatterns(*optExclude)); s != nil {
+		opts.Select = s.Selected
 	}
 
-	//
-	// ??? Consider adding optimizations to elide overwrite based on mtime,
-	// hash, mode, and size
-	//
-
-	// Read in file contents and validate hash
-	hashDest := xxhash.New64()
-	fileScratch.Reset()
-	fileScratch.Grow(int(size))
-	c, err := fileScratch.ReadFrom(io.TeeReader(r, hashDest))
+	root, err := os.Getwd()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	if c < int64(size) {
-		return errors.Wrapf(io.ErrUnexpectedEOF, "read fewer than expected bytes: %d < %d", c, size)
-	}
-	if hs, hd := uint64(hashSource), hashDest.Sum64(); hs != hd {
-		return errors.Errorf("hash mismatch: % x != % x", hs, hd)
+	r := newProgressReporter()
+	if r != nil {
+		opts.Progress = r.update
+		defer r.finish()
 	}
+	opts.Events = entryEvents()
 
-	// When exists, but wrong type...
-	fi, err := os.Lstat(string(targetBase))
+	dedup, err := saf.ParseDedup(*optDedup)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return errors.WithStack(err)
-		}
-	} else if !fi.Mode().IsRegular() {
-		if err = os.RemoveAll(string(targetBase)); err != nil {
-			return errors.WithStack(err)
+		return badUsage(err)
+	}
+	var sink saf.Sink = saf.DirSink(root)
+	switch {
+	case *optDryRun:
+		sink = newDryRunSink(root, os.Stdout)
+	case dedup != saf.DedupNone:
+		ds := saf.NewDedupSink(root, dedup, *optDedupIndex, cliLogger{})
+		defer func() {
+			if err := ds.Save(); err != nil {
+				warning("%s\n", err)
+			}
+		}()
+		sink = ds
+	}
+
+	xopts := saf.ExtractorOptions{Events: opts.Events, Logger: cliLogger{}}
+	if opts.VerifyKey != nil {
+		if *optStrictVerify {
+			// Nothing is extracted until the entire stream is verified.
+			return extractSpooled(opts, root, saf.NewExtractor(sink, xopts))
 		}
+		// Entries are extracted as received, but not committed until the
+		// stream is verified. A dry run changes nothing, so it reports the
+		// changes as received, and fails when the stream is not verified.
+		xopts.Deferred = !*optDryRun
 	}
+	x := saf.NewExtractor(sink, xopts)
 
-	//
-	// TODO: deal with situation when requested permissions prevent
-	// modifications
-	//
-
-	fh, err := os.OpenFile(string(targetBase), os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	// Read from tee reader, causing data to be also written to hash.
-	c, err = fileScratch.WriteTo(fh)
-	if err != nil {
-		_ = fh.Close() // ignore secondary error
-		return errors.WithStack(err)
-	}
-	if c < int64(size) {
-		_ = fh.Close() // ignore secondary error
-		return errors.Wrapf(io.ErrShortWrite, "%d < %d", c, size)
-	}
-
-	// Truncate file after size bytes to handle smaller source than destination.
-	if err = fh.Truncate(c); err != nil {
-		_ = fh.Close() // ignore secondary error
-		return errors.WithStack(err)
-	}
-	if err = fh.Chmod(os.FileMode(mode).Perm()); err != nil {
-		return errors.WithStack(err)
-	}
-	if err = fh.Close(); err != nil {
-		return errors.WithStack(err)
-	}
-	t := time.Unix(int64(mtime), 0)
-	return os.Chtimes(string(targetBase), t, t)
+	err = decodeInput(opts, func(d *saf.Decoder) saf.Visitor {
+		if ix := d.Index(); ix != nil {
+			r.setTotal(selectedTotal(ix, opts.Select))
+		}
+		return extractVisitor{Extractor: x, root: root, hash: d.Header().Hash}
+	})
+	x.Finish(err == nil)
+	return err
 }
 
-func decodeSocket(r io.Reader) error {
-	var err error
-	var targetBase gobsp.String
-	var mtime gobsp.Int64
-	var mode gobsp.Uint32
-
-	if err = targetBase.UnmarshalBinaryFrom(r); err != nil {
-		return err
-	}
-	debug("%s decode socket\n", targetBase)
-
-	if err = mtime.UnmarshalBinaryFrom(r); err != nil {
-		return err
-	}
-
-	if err = mode.UnmarshalBinaryFrom(r); err != nil {
-		return err
+// selectedTotal returns the number of entries and bytes in the index that
+// are visited when selecting entries, which includes the directories
+// containing the selected entries, or all of them when selected is nil.
+func selectedTotal(ix saf.Index, selected func(string) bool) saf.Progress {
+	visited := make(map[string]struct{})
+	if selected != nil {
+		for i := range ix {
+			if p := ix[i].Entry.Path; selected(p) {
+				for ; p != "." && p != "/"; p = path.Dir(p) {
+					visited[p] = struct{}{}
+				}
+			}
+		}
 	}
 
-	// When exists, but wrong type...
-	fi, err := os.Lstat(string(targetBase))
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return errors.Wrap(err, "cannot decode named pipe")
+	var total saf.Progress
+	for i := range ix {
+		entry := &ix[i].Entry
+		if _, ok := visited[entry.Path]; selected != nil && !ok {
+			continue
 		}
-	} else if fi.Mode()&os.ModeSocket == 0 {
-		if err = os.RemoveAll(string(targetBase)); err != nil {
-			return errors.Wrap(err, "cannot decode named pipe")
+		total.Entries++
+		if entry.Mode.IsRegular() {
+			total.Bytes += entry.Size
 		}
 	}
-
-	err = makeSocket(string(targetBase), uint32(mode), time.Unix(int64(mtime), 0))
-	return errors.Wrap(err, "cannot decode socket")
+	return total
 }
 
-func decodeSymlink(r io.Reader) error {
-	var err error
-	var targetBase gobsp.String // base name of symbolic link we are making
-	var linkname gobsp.String   // symbolic link will point to this file system entry
-	var mtime gobsp.Int64
-	var mode gobsp.Uint32
-
-	if err = targetBase.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode name")
+// extractSpooled copies the entire stream to a temporary file, and verifies
+// the trailer and signature of the copy before extracting its entries. The
+// stream is spooled as received, so an encrypted stream is not written to the
+// temporary file as plaintext. Progress and entry events are only reported
+// while extracting.
+func extractSpooled(opts saf.DecoderOptions, root string, x *saf.Extractor) error {
+	r, fh, err := openInput()
+	if err != nil {
+		return err
 	}
-	debug("%s symlink\n", targetBase)
-	if err = linkname.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode referent")
+	spool, err := ioutil.TempFile("", "tsync-spool-")
+	if err == nil {
+		defer func() {
+			_ = spool.Close()           // ignore secondary error
+			_ = os.Remove(spool.Name()) // ignore secondary error
+		}()
+		_, err = io.Copy(spool, r)
+		err = errors.Wrap(err, "cannot spool stream")
 	}
-	if err = mtime.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode modification time")
+	if fh != nil {
+		if err2 := fh.Close(); err == nil {
+			err = err2
+		}
 	}
-	if err = mode.UnmarshalBinaryFrom(r); err != nil {
-		return errors.Wrap(err, "cannot decode mode")
+	if err != nil {
+		return err
 	}
 
-	// When exists, but wrong type...
-	fi, err := os.Lstat(string(targetBase))
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return errors.WithStack(err)
+	progress, events := opts.Progress, opts.Events
+	for i, v := range []func(*saf.Decoder) saf.Visitor{
+		func(*saf.Decoder) saf.Visitor { return discardVisitor{} },
+		func(d *saf.Decoder) saf.Visitor {
+			return extractVisitor{Extractor: x, root: root, hash: d.Header().Hash}
+		},
+	} {
+		opts.Progress, opts.Events = nil, nil
+		if i == 1 {
+			opts.Progress, opts.Events = progress, events
 		}
-	} else if fi.Mode()&os.ModeSymlink == 0 {
-		if err = os.RemoveAll(string(targetBase)); err != nil {
+		if _, err = spool.Seek(0, io.SeekStart); err != nil {
 			return errors.WithStack(err)
 		}
+		d, err := saf.NewDecoder(spool, opts)
+		if err != nil {
+			return err
+		}
+		err = d.Decode(v(d))
+		if i == 1 {
+			activeStats.decoded(d.Stats())
+		}
+		if err != nil {
+			return err
+		}
 	}
-
-	if err = os.Symlink(string(linkname), string(targetBase)); err != nil {
-		return errors.WithStack(err)
-	}
-
-	// t := time.Unix(int64(mtime), 0)
-	// if err = os.Chtimes(string(targetBase), t, t); err != nil {
-	// 	return errors.WithStack(err)
-	// }
-
-	// if err = os.Chmod(string(targetBase), os.FileMode(mode).Perm()); err != nil {
-	// 	return errors.WithStack(err)
-	// }
-
 	return nil
+}
 
-	// wd, err := os.Getwd()
-	// if err != nil {
-	// 	return errors.WithStack(err)
-	// }
-
-	// fh, err := os.Open(wd)
-	// if err != nil {
-	// 	return errors.WithStack(err)
-	// }
-	// defer fh.Close()
+// extractVisitor extracts each entry, printing the name and hash of each
+// regular file when verbose.
+type extractVisitor struct {
+	*saf.Extractor
+	root string
+	hash saf.HashAlgorithm
+}
 
-	// dirfd := int(fh.Fd())
+func (v extractVisitor) Visit(entry *saf.Entry, contents io.Reader) error {
+	if err := v.Extractor.Visit(entry, contents); err != nil {
+		return err
+	}
+	if entry.Mode.IsRegular() {
+		verbose("%s %s:%x\n", filepath.Join(v.root, filepath.FromSlash(entry.Path)), v.hash, entry.Hash)
+	}
+	return nil
+}
 
-	// targetFull := filepath.Join(wd, string(targetBase))
-	// mode := uint32(fi.Mode()) // ??? why trying to get mode of possibly non existing entry
-	// flags := unix.AT_SYMLINK_NOFOLLOW
+// discardVisitor ignores every entry.
+type discardVisitor struct{}
 
-	// return errors.WithStack(chmod(dirfd, targetFull, mode, flags))
-}
+func (discardVisitor) Visit(*saf.Entry, io.Reader) error { return nil }
+func (discardVisitor) Ascend(*saf.Entry) error           { return nil }
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -91,3 +92,24 @@ func TestParentAndBase(t *testing.T) {
 		}
 	})
 }
+
+func TestFilterFlags(t *testing.T) {
+	cases := []struct {
+		args []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"create", "--include", "a", "--exclude", "b", "foo"}, []string{"include", "exclude"}},
+		{[]string{"create", "--exclude-from", "rules", "--exclude", "b", "--include", "a"}, []string{"exclude-from", "exclude", "include"}},
+		{[]string{"--include", "a", "--exclude", "b", "--include", "c"}, []string{"exclude", "include"}},
+		{[]string{"--exclude", "--include", "foo"}, []string{"exclude"}}, // value looks like a flag
+		{[]string{"--exclude", "b", "--", "--include"}, []string{"exclude"}},
+		{[]string{"include", "exclude"}, nil},
+	}
+
+	for _, c := range cases {
+		if got := filterFlags(c.args); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: GOT: %q; WANT: %q", c.args, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/karrick/tsync/saf"
+)
+
+// activeProgress is the progress display on standard error, if any, which
+// is cleared before other messages are printed.
+var activeProgress *progressReporter
+
+// progressReporter displays the progress of creating or extracting a stream.
+// When standard error is a terminal, a single status line is redrawn as
+// entries are processed, otherwise a log line is printed periodically.
+type progressReporter struct {
+	terminal bool
+	interval time.Duration
+	start    time.Time
+	last     time.Time // when progress was last displayed
+	drawn    bool      // true when the status line is on the terminal
+	current  saf.Progress
+	total    *saf.Progress // nil when the total is unknown
+}
+
+// newProgressReporter returns a progressReporter when progress was
+// requested, or nil, in which case its methods do nothing.
+func newProgressReporter() *progressReporter {
+	if !*optProgress && !*optVerbose {
+		return nil
+	}
+	r := &progressReporter{interval: 10 * time.Second, start: time.Now()}
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		r.terminal, r.interval = true, 100*time.Millisecond
+	}
+	r.last = r.start
+	activeProgress = r
+	return r
+}
+
+// setTotal sets the number of entries and bytes expected, which allows the
+// remaining time to be estimated.
+func (r *progressReporter) setTotal(total saf.Progress) {
+	if r != nil {
+		r.total = &total
+	}
+}
+
+// update records the progress, and displays it when the interval has passed
+// since it was last displayed.
+func (r *progressReporter) update(p saf.Progress) {
+	r.current = p
+	if now := time.Now(); now.Sub(r.last) >= r.interval {
+		r.last = now
+		r.display(now)
+	}
+}
+
+func (r *progressReporter) display(now time.Time) {
+	if r.terminal {
+		_, _ = fmt.Fprintf(os.Stderr, "\r\033[K%s", r.status(now))
+		r.drawn = true
+	} else {
+		logMessage("progress", "[PROGRESS] ", "%s\n", r.status(now))
+	}
+}
+
+// clear erases the status line from the terminal, so another message may be
+// printed. The status line is redrawn with the next update.
+func (r *progressReporter) clear() {
+	if r != nil && r.drawn {
+		_, _ = fmt.Fprint(os.Stderr, "\r\033[K")
+		r.drawn = false
+	}
+}
+
+// finish displays the final progress, and stops displaying progress.
+func (r *progressReporter) finish() {
+	if r == nil {
+		return
+	}
+	r.display(time.Now())
+	if r.drawn {
+		_, _ = fmt.Fprintln(os.Stderr)
+		r.drawn = false
+	}
+	if activeProgress == r {
+		activeProgress = nil
+	}
+}
+
+// status returns the line describing the progress at the specified time.
+func (r *progressReporter) status(now time.Time) string {
+	elapsed := now.Sub(r.start)
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(r.current.Bytes) / elapsed.Seconds()
+	}
+
+	var s string
+	if r.total == nil {
+		s = fmt.Sprintf("%d entries, %s (%s/s)", r.current.Entries, formatBytes(float64(r.current.Bytes)), formatBytes(rate))
+	} else {
+		s = fmt.Sprintf("%d/%d entries, %s/%s (%s/s)", r.current.Entries, r.total.Entries, formatBytes(float64(r.current.Bytes)), formatBytes(float64(r.total.Bytes)), formatBytes(rate))
+		if eta, ok := r.eta(elapsed); ok {
+			s += ", ETA " + eta.String()
+		}
+	}
+	if r.current.Path != "" {
+		s += " " + shortenPath(r.current.Path, 40)
+	}
+	return s
+}
+
+// eta estimates the time remaining from the fraction of the bytes, or when
+// there are no bytes, the fraction of the entries, processed so far.
+func (r *progressReporter) eta(elapsed time.Duration) (time.Duration, bool) {
+	done, total := r.current.Bytes, r.total.Bytes
+	if total == 0 {
+		done, total = r.current.Entries, r.total.Entries
+	}
+	if done <= 0 || done >= total {
+		return 0, false
+	}
+	remaining := time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+	return remaining.Round(time.Second), true
+}
+
+// formatBytes returns size formatted with binary prefixes.
+func formatBytes(size float64) string {
+	const units = "KMGTPE"
+	if size < 1024 {
+		return fmt.Sprintf("%.0f B", size)
+	}
+	i := -1
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, units[i])
+}
+
+// shortenPath returns pathname, with its leading characters elided when it
+// is longer than max.
+func shortenPath(pathname string, max int) string {
+	if len(pathname) <= max {
+		return pathname
+	}
+	i := len(pathname) - max + 3
+	for i < len(pathname) && !utf8.RuneStart(pathname[i]) {
+		i++
+	}
+	return "..." + pathname[i:]
+}
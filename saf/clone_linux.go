@@ -0,0 +1,13 @@
+package saf
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// clone makes dst share the contents of src with FICLONE, which fails unless
+// both are on the same file system, and it supports sharing data blocks.
+func clone(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package saf
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// clone returns an error because cloning files is not yet supported on this
+// operating system.
+func clone(dst, src *os.File) error {
+	return errors.New("cannot clone file: not supported")
+}
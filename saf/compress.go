@@ -0,0 +1,170 @@
+package saf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+// Codec identifies the compression algorithm used for the contents of a
+// regular file. The sender records the codec it selected in the stream header,
+// and each regular file message records the codec its contents were actually
+// encoded with, because the sender may elect not to compress some files.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota // 0 file contents are not compressed
+	CodecGzip              // 1
+	CodecZstd              // 2
+	CodecLZ4               // 3
+
+	// codecReferenced is recorded in place of the codec of a regular file
+	// whose contents are not sent, because the receiver has contents with
+	// the same hash.
+	codecReferenced Codec = 255
+)
+
+// ParseCodec returns the codec with the specified name: none, gzip, zstd, or
+// lz4.
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return CodecNone, nil
+	case "gzip":
+		return CodecGzip, nil
+	case "zstd":
+		return CodecZstd, nil
+	case "lz4":
+		return CodecLZ4, nil
+	}
+	return CodecNone, errors.Errorf("unknown compression codec: %q", name)
+}
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecZstd:
+		return "zstd"
+	case CodecLZ4:
+		return "lz4"
+	case codecReferenced:
+		return "referenced"
+	}
+	return "codec(" + strconv.Itoa(int(c)) + ")"
+}
+
+// zstdEncoder is shared because it is expensive to create and is safe to
+// reuse for each file.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// Compress appends the compressed form of buf to w.
+func (c Codec) Compress(w *bytes.Buffer, buf []byte) error {
+	switch c {
+	case CodecNone:
+		_, err := w.Write(buf)
+		return err
+	case CodecGzip:
+		zw := gzip.NewWriter(w)
+		if _, err := zw.Write(buf); err != nil {
+			return err
+		}
+		return zw.Close()
+	case CodecZstd:
+		_, err := w.Write(zstdEncoder.EncodeAll(buf, nil))
+		return err
+	case CodecLZ4:
+		zw := lz4.NewWriter(w)
+		if _, err := zw.Write(buf); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	return errors.Errorf("cannot compress with unknown codec: %s", c)
+}
+
+// Decompress appends the decompressed contents read from r to w. Contents
+// are expected to be size bytes, and decompressing stops with an error once
+// there are more, so a small payload cannot expand without bound.
+func (c Codec) Decompress(w *bytes.Buffer, r io.Reader, size int64) error {
+	var err error
+	var zr io.Reader
+
+	switch c {
+	case CodecNone:
+		zr = r
+	case CodecGzip:
+		if zr, err = gzip.NewReader(r); err != nil {
+			return err
+		}
+	case CodecZstd:
+		zd, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer zd.Close()
+		zr = zd
+	case CodecLZ4:
+		zr = lz4.NewReader(r)
+	default:
+		return errors.Errorf("cannot decompress with unknown codec: %s", c)
+	}
+
+	n, err := w.ReadFrom(io.LimitReader(zr, size+1))
+	if err != nil {
+		return err
+	}
+	if n > size {
+		return errors.Errorf("decompressed contents exceed expected size: %d", size)
+	}
+	return nil
+}
+
+// compressedExtensions are file name extensions of file types whose contents
+// are already compressed, and gain nothing from being compressed again.
+var compressedExtensions = map[string]struct{}{
+	".7z":   {},
+	".avi":  {},
+	".bz2":  {},
+	".deb":  {},
+	".docx": {},
+	".flac": {},
+	".gif":  {},
+	".gz":   {},
+	".jar":  {},
+	".jpeg": {},
+	".jpg":  {},
+	".lz4":  {},
+	".mkv":  {},
+	".mov":  {},
+	".mp3":  {},
+	".mp4":  {},
+	".ogg":  {},
+	".png":  {},
+	".rpm":  {},
+	".tgz":  {},
+	".webm": {},
+	".webp": {},
+	".xlsx": {},
+	".xz":   {},
+	".zip":  {},
+	".zst":  {},
+}
+
+// ForName returns the codec to use for the file named targetBase, which is
+// CodecNone for files whose contents are already compressed.
+func (c Codec) ForName(targetBase string) Codec {
+	if _, ok := compressedExtensions[strings.ToLower(filepath.Ext(targetBase))]; ok {
+		return CodecNone
+	}
+	return c
+}
@@ -0,0 +1,51 @@
+package saf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	original := bytes.Repeat([]byte("tsync compresses file contents\n"), 100)
+
+	for _, c := range []Codec{CodecNone, CodecGzip, CodecZstd, CodecLZ4} {
+		t.Run(c.String(), func(t *testing.T) {
+			compressed := new(bytes.Buffer)
+			if err := c.Compress(compressed, original); err != nil {
+				t.Fatal(err)
+			}
+			if c != CodecNone && compressed.Len() >= len(original) {
+				t.Errorf("GOT: %v; WANT: < %v", compressed.Len(), len(original))
+			}
+
+			decompressed := new(bytes.Buffer)
+			if err := c.Decompress(decompressed, compressed, int64(len(original))); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := decompressed.Bytes(), original; !bytes.Equal(got, want) {
+				t.Errorf("GOT: %q; WANT: %q", got, want)
+			}
+
+			// Contents that expand beyond their size are rejected.
+			if err := c.Compress(compressed, original); err != nil {
+				t.Fatal(err)
+			}
+			decompressed.Reset()
+			if err := c.Decompress(decompressed, compressed, int64(len(original))-1); err == nil {
+				t.Errorf("GOT: nil; WANT: error")
+			}
+			if decompressed.Len() > len(original) {
+				t.Errorf("GOT: %d bytes; WANT: <= %d", decompressed.Len(), len(original))
+			}
+		})
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	if got, want := CodecZstd.ForName("photo.JPG"), CodecNone; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := CodecZstd.ForName("notes.txt"), CodecZstd; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package saf
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Copier walks the file system like the AddPath method of an Encoder, but
+// rather than sending each entry in a stream, it invokes a Visitor with it,
+// such as an Extractor that creates it in a DirSink. The contents of each
+// regular file are read directly from the file being copied, so an Extractor
+// writing to a DirSink copies them with copy_file_range where the operating
+// system supports it, or otherwise by reading and writing them.
+//
+// Only the options that apply to entries added by AddPath, along with
+// Progress, Events, and Logger, are used. A Copier is not safe for concurrent
+// use.
+type Copier struct {
+	e *Encoder
+}
+
+// NewCopier returns a Copier that visits entries with v.
+func NewCopier(v Visitor, opts EncoderOptions) *Copier {
+	e := newEncoder(opts)
+	e.visitor = v
+	return &Copier{e: e}
+}
+
+// AddPath visits the file system entry at pathname, and when it is a
+// directory, every entry below it that is not filtered out. It returns an
+// error when pathname itself cannot be visited, but only reports entries
+// below it that cannot be visited to the Logger as warnings.
+func (c *Copier) AddPath(pathname string) error { return c.e.AddPath(pathname) }
+
+// Stats returns the counts of the entries visited so far.
+func (c *Copier) Stats() Stats { return c.e.Stats() }
+
+// copyFile visits the regular file with its contents read from the file.
+func (e *Encoder) copyFile(targetFull string) error {
+	fh, err := os.Open(targetFull)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	fi, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close() // ignore secondary error
+		return errors.WithStack(err)
+	}
+
+	entry := e.infoEntry(targetFull, fi)
+	entry.Size = fi.Size()
+	e.contents = io.LimitReader(fh, fi.Size())
+	err = e.sendEntry(entry, targetFull)
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	return errors.WithStack(err)
+}
+
+// visitEntry visits the entry in place of sending it, and makes a directory
+// the directory of the following entries.
+func (e *Encoder) visitEntry(entry *Entry, targetFull string) error {
+	contents := e.contents
+	e.contents = nil
+	if err := e.visitor.Visit(entry, contents); err != nil {
+		return err
+	}
+	e.log.Verbosef("%s\n", targetFull)
+	if entry.Mode.IsDir() {
+		e.visitDirs = append(e.visitDirs, entry)
+	}
+	e.sent(entry, ActionCopied)
+	return nil
+}
+
+// visitAscend ascends out of the directory of the most recently visited
+// entry.
+func (e *Encoder) visitAscend() error {
+	dir := e.visitDirs[len(e.visitDirs)-1]
+	e.visitDirs = e.visitDirs[:len(e.visitDirs)-1]
+	return e.visitor.Ascend(dir)
+}
@@ -0,0 +1,79 @@
+package saf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopier(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	src := t.TempDir()
+	top := filepath.Join(src, "top")
+	if err := os.MkdirAll(filepath.Join(top, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"a/b": "top/a/b", "c": "top/c", "skip.tmp": "skip"} {
+		if err := ioutil.WriteFile(filepath.Join(top, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("c", filepath.Join(top, "l")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/b", "c", "a", "."} {
+		if err := os.Chtimes(filepath.Join(top, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := t.TempDir()
+	var copied int
+	c := NewCopier(NewExtractor(DirSink(dst), ExtractorOptions{}), EncoderOptions{
+		Filter: NewFilter(nil, []string{"*.tmp"}),
+		Events: func(ev Event) {
+			if ev.Action == ActionCopied {
+				copied++
+			}
+		},
+	})
+	if err := c.AddPath(top); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"top/a/b": "top/a/b", "top/c": "top/c"} {
+		pathname := filepath.Join(dst, filepath.FromSlash(name))
+		got, err := ioutil.ReadFile(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: GOT: %q; WANT: %q", name, got, want)
+		}
+		fi, err := os.Stat(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: GOT: %s %s; WANT: %s %s", name, fi.Mode().Perm(), fi.ModTime(), os.FileMode(0600), mtime)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "top")); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("GOT: %v; WANT: directory modified at %s", err, mtime)
+	}
+	if linkname, err := os.Readlink(filepath.Join(dst, "top", "l")); err != nil || linkname != "c" {
+		t.Errorf("GOT: %q %v; WANT: c", linkname, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "top", "skip.tmp")); !os.IsNotExist(err) {
+		t.Errorf("GOT: %v; WANT: not exist", err)
+	}
+
+	if got, want := c.Stats(), (Stats{Directories: 2, Files: 2, Symlinks: 1, Bytes: 12, Skipped: 1}); got != want {
+		t.Errorf("GOT: %+v; WANT: %+v", got, want)
+	}
+	if copied != 5 {
+		t.Errorf("GOT: %d; WANT: 5 copied events", copied)
+	}
+}
@@ -0,0 +1,366 @@
+package saf
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted streams begin with cryptMagic, followed by the key derivation
+// parameters, followed by a sequence of chunks. Each chunk has a one byte flag
+// that is non-zero for the final chunk, a four byte big endian length of the
+// sealed contents, and the sealed contents. Every chunk is authenticated with
+// the stream header, its flag, and its sequence number before any of its
+// plaintext is released, so tampering, reordering, and truncation are all
+// detected before any message handler sees the data.
+const cryptMagic = "TSYNCAE1"
+
+// cryptChunkSize is the maximum number of plaintext bytes sealed in a single
+// chunk.
+const cryptChunkSize = 64 * 1024
+
+// kdf identifies how the stream key is derived from the secret provided by
+// the user. In both cases a random salt makes each stream key unique, so the
+// chunk sequence number may safely be used as the nonce.
+type kdf uint8
+
+const (
+	kdfKeyFile    kdf = iota + 1 // 1 HKDF-SHA256 of key file contents
+	kdfPassphrase                // 2 scrypt of passphrase
+)
+
+// Scrypt work factors used when encrypting with a passphrase. They are stored
+// in the stream header so they may be increased without breaking existing
+// archives.
+const (
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+)
+
+// Largest scrypt work factors accepted from a stream header, which is read
+// before anything is authenticated, so a crafted header cannot exhaust the
+// memory or time of the recipient. Scrypt needs 128·r·2^logN bytes of memory.
+const (
+	scryptMaxLogN   = 20
+	scryptMaxRP     = 64
+	scryptMaxMemory = 1 << 30
+)
+
+const cryptSaltSize = 32
+
+// Secret is the secret provided by the user to encrypt or decrypt a stream,
+// and how it is turned into a stream key.
+type Secret struct {
+	kdf    kdf
+	secret []byte
+}
+
+// NewKeySecret returns a secret that derives stream keys from key, which must
+// be at least 32 bytes, such as the contents of a key file.
+func NewKeySecret(key []byte) (*Secret, error) {
+	if len(key) < 32 {
+		return nil, errors.Errorf("cannot use key: too short: %d < 32 bytes", len(key))
+	}
+	return &Secret{kdf: kdfKeyFile, secret: key}, nil
+}
+
+// NewPassphraseSecret returns a secret that derives stream keys from
+// passphrase using scrypt.
+func NewPassphraseSecret(passphrase []byte) (*Secret, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("cannot use passphrase: empty passphrase")
+	}
+	return &Secret{kdf: kdfPassphrase, secret: passphrase}, nil
+}
+
+// deriveAEAD returns the AEAD cipher for the key derived from the secret
+// using the parameters in the stream header.
+func (cs *Secret) deriveAEAD(header []byte) (cipher.AEAD, error) {
+	var key []byte
+	var err error
+
+	params, salt := header[len(cryptMagic):len(header)-cryptSaltSize], header[len(header)-cryptSaltSize:]
+
+	switch kdf(params[0]) {
+	case kdfKeyFile:
+		if cs.kdf != kdfKeyFile {
+			return nil, errors.New("archive was encrypted with a key file")
+		}
+		key = make([]byte, 32)
+		_, err = io.ReadFull(hkdf.New(sha256.New, cs.secret, salt, []byte(cryptMagic)), key)
+	case kdfPassphrase:
+		if cs.kdf != kdfPassphrase {
+			return nil, errors.New("archive was encrypted with a passphrase")
+		}
+		logN, r, p := params[1], params[2], params[3]
+		if logN == 0 || logN > scryptMaxLogN || r == 0 || p == 0 || int(r)*int(p) > scryptMaxRP || 128*int64(r)<<logN > scryptMaxMemory {
+			return nil, errors.Errorf("invalid scrypt parameters: logN: %d; r: %d; p: %d", logN, r, p)
+		}
+		key, err = scrypt.Key(cs.secret, salt, 1<<logN, int(r), int(p), 32)
+	default:
+		return nil, errors.Errorf("unknown key derivation function: %d", params[0])
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot derive key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cryptHeaderSize returns the size of the stream header for the kdf.
+func cryptHeaderSize(k kdf) int {
+	if k == kdfPassphrase {
+		return len(cryptMagic) + 4 + cryptSaltSize
+	}
+	return len(cryptMagic) + 1 + cryptSaltSize
+}
+
+// chunkNonce returns the nonce for the specified chunk. The final flag is
+// part of the nonce so a chunk cannot be relabeled as the final chunk.
+func chunkNonce(nonce []byte, sequence uint64, final bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce, sequence)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals everything written to it into chunks written to the
+// underlying io.Writer. Close must be invoked to write the final chunk, but
+// does not close the underlying io.Writer.
+type encryptWriter struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	header    []byte
+	plaintext []byte
+	sealed    []byte
+	nonce     []byte
+	sequence  uint64
+}
+
+// NewEncryptWriter writes the encryption header to w, and returns an
+// io.WriteCloser that seals everything written to it into authenticated chunks
+// written to w. It must be closed to write the final chunk, but closing it
+// does not close w.
+func NewEncryptWriter(w io.Writer, cs *Secret) (io.WriteCloser, error) {
+	return newEncryptWriter(w, cs)
+}
+
+func newEncryptWriter(w io.Writer, cs *Secret) (*encryptWriter, error) {
+	header := make([]byte, 0, cryptHeaderSize(cs.kdf))
+	header = append(header, cryptMagic...)
+	if cs.kdf == kdfPassphrase {
+		header = append(header, byte(cs.kdf), scryptLogN, scryptR, scryptP)
+	} else {
+		header = append(header, byte(cs.kdf))
+	}
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "cannot create salt")
+	}
+	header = append(header, salt...)
+
+	aead, err := cs.deriveAEAD(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:         w,
+		aead:      aead,
+		header:    header,
+		plaintext: make([]byte, 0, cryptChunkSize),
+		nonce:     make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, because only
+		// Close knows which chunk is final.
+		if len(ew.plaintext) == cryptChunkSize {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.plaintext[len(ew.plaintext):cryptChunkSize], p)
+		ew.plaintext = ew.plaintext[:len(ew.plaintext)+n]
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close seals and writes the final chunk.
+func (ew *encryptWriter) Close() error {
+	return ew.seal(true)
+}
+
+func (ew *encryptWriter) seal(final bool) error {
+	var prefix [5]byte
+	if final {
+		prefix[0] = 1
+	}
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(ew.plaintext)+ew.aead.Overhead()))
+
+	ew.sealed = ew.aead.Seal(ew.sealed[:0], chunkNonce(ew.nonce, ew.sequence, final), ew.plaintext, chunkAdditionalData(ew.header, prefix[0]))
+	ew.sequence++
+	ew.plaintext = ew.plaintext[:0]
+
+	if _, err := ew.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := ew.w.Write(ew.sealed)
+	return err
+}
+
+// chunkAdditionalData binds each chunk to the stream header so the key
+// derivation parameters cannot be altered.
+func chunkAdditionalData(header []byte, flag byte) []byte {
+	ad := make([]byte, len(header)+1)
+	copy(ad, header)
+	ad[len(header)] = flag
+	return ad
+}
+
+// decryptReader returns the plaintext of each chunk read from the underlying
+// io.Reader, only after the chunk has been authenticated.
+type decryptReader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	header    []byte
+	sealed    []byte
+	plaintext []byte
+	nonce     []byte
+	sequence  uint64
+	final     bool
+}
+
+// NewDecryptReader reads the encryption header from r, and returns an
+// io.Reader of the plaintext of each chunk read from r, which is only
+// released after the chunk has been authenticated.
+func NewDecryptReader(r io.Reader, cs *Secret) (io.Reader, error) {
+	return newDecryptReader(r, cs)
+}
+
+func newDecryptReader(r io.Reader, cs *Secret) (*decryptReader, error) {
+	header := make([]byte, len(cryptMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "cannot read encryption header")
+	}
+	if string(header[:len(cryptMagic)]) != cryptMagic {
+		return nil, errors.New("stream is not encrypted")
+	}
+	rest := make([]byte, cryptHeaderSize(kdf(header[len(cryptMagic)]))-len(header))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, errors.Wrap(err, "cannot read encryption header")
+	}
+	header = append(header, rest...)
+
+	aead, err := cs.deriveAEAD(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plaintext) == 0 {
+		if dr.final {
+			// Any data following the final chunk was not written by the
+			// sender.
+			if _, err := io.ReadFull(dr.r, make([]byte, 1)); err == nil {
+				return 0, errors.New("cannot decrypt: data after final chunk")
+			}
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.plaintext)
+	dr.plaintext = dr.plaintext[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) open() error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(dr.r, prefix[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrap(err, "cannot decrypt: stream truncated")
+	}
+	if prefix[0] > 1 {
+		return errors.Errorf("cannot decrypt: invalid chunk flag: %d", prefix[0])
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size < uint32(dr.aead.Overhead()) || size > uint32(cryptChunkSize+dr.aead.Overhead()) {
+		return errors.Errorf("cannot decrypt: invalid chunk size: %d", size)
+	}
+
+	if cap(dr.sealed) < int(size) {
+		dr.sealed = make([]byte, size)
+	}
+	dr.sealed = dr.sealed[:size]
+	if _, err := io.ReadFull(dr.r, dr.sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrap(err, "cannot decrypt: stream truncated")
+	}
+
+	final := prefix[0] == 1
+	plaintext, err := dr.aead.Open(dr.sealed[:0], chunkNonce(dr.nonce, dr.sequence, final), dr.sealed, chunkAdditionalData(dr.header, prefix[0]))
+	if err != nil {
+		return errors.Errorf("cannot decrypt: chunk %d failed authentication", dr.sequence)
+	}
+	dr.sequence++
+	dr.final = final
+	dr.plaintext = plaintext
+	return nil
+}
+
+// maybeDecrypt returns an io.Reader that decrypts r with cs when it begins
+// with an encrypted stream header, or returns an io.Reader of the plaintext
+// stream otherwise. It returns ErrEncrypted when the stream is encrypted but
+// cs is nil.
+func maybeDecrypt(r io.Reader, cs *Secret) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(cryptMagic))
+	if err != nil || string(magic) != cryptMagic {
+		// Too short to be encrypted, so let the scanner report any problem.
+		return br, nil
+	}
+	if cs == nil {
+		return nil, ErrEncrypted
+	}
+	return newDecryptReader(br, cs)
+}
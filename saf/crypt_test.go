@@ -0,0 +1,93 @@
+package saf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	cs := &Secret{kdf: kdfKeyFile, secret: bytes.Repeat([]byte("k"), 32)}
+	original := bytes.Repeat([]byte("0123456789"), cryptChunkSize/4) // spans several chunks
+
+	sealed := new(bytes.Buffer)
+	ew, err := newEncryptWriter(sealed, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ew.Write(original); err != nil {
+		t.Fatal(err)
+	}
+	if err = ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		dr, err := newDecryptReader(bytes.NewReader(sealed.Bytes()), cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(dr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, original) {
+			t.Errorf("GOT: %d bytes; WANT: %d bytes", len(got), len(original))
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := append([]byte(nil), sealed.Bytes()...)
+		tampered[len(tampered)/2] ^= 1
+		dr, err := newDecryptReader(bytes.NewReader(tampered), cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ioutil.ReadAll(dr); err == nil {
+			t.Fatal("GOT: nil; WANT: error")
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		dr, err := newDecryptReader(bytes.NewReader(sealed.Bytes()[:sealed.Len()-100]), cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ioutil.ReadAll(dr); err == nil {
+			t.Fatal("GOT: nil; WANT: error")
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		other := &Secret{kdf: kdfKeyFile, secret: bytes.Repeat([]byte("x"), 32)}
+		dr, err := newDecryptReader(bytes.NewReader(sealed.Bytes()), other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ioutil.ReadAll(dr); err == nil {
+			t.Fatal("GOT: nil; WANT: error")
+		}
+	})
+}
+
+func TestScryptParameters(t *testing.T) {
+	cs := &Secret{kdf: kdfPassphrase, secret: []byte("passphrase")}
+	for _, tc := range []struct {
+		logN, r, p byte
+		ok         bool
+	}{
+		{10, 8, 1, true},
+		{scryptMaxLogN + 1, 8, 1, false},
+		{30, 8, 1, false},
+		{10, 255, 255, false},
+		{10, 65, 1, false},
+		{20, 16, 1, false}, // 2 GiB
+		{10, 8, 0, false},
+	} {
+		header := append([]byte(cryptMagic), byte(kdfPassphrase), tc.logN, tc.r, tc.p)
+		header = append(header, make([]byte, cryptSaltSize)...)
+		if _, err := cs.deriveAEAD(header); (err == nil) != tc.ok {
+			t.Errorf("logN: %d; r: %d; p: %d: GOT: %v; WANT: ok %t", tc.logN, tc.r, tc.p, err, tc.ok)
+		}
+	}
+}
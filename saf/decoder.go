@@ -0,0 +1,534 @@
+package saf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// DecoderOptions configures a Decoder. The zero value decodes every entry of
+// an unencrypted stream without requiring a signature.
+type DecoderOptions struct {
+	Secret *Secret // decrypts an encrypted stream
+
+	// VerifyKey requires the stream to be signed by the holder of the
+	// matching private key when not nil. Signature is the detached signature
+	// of the stream, when it was not sent in the stream.
+	VerifyKey ed25519.PublicKey
+	Signature []byte
+
+	// Select is invoked with the path of each entry when not nil, and only
+	// the entries it returns true for are visited, along with the directories
+	// containing them.
+	Select func(pathname string) bool
+
+	// Rewriter renames entries after they are selected when not nil.
+	Rewriter *Rewriter
+
+	// Progress is invoked after each entry is visited when not nil, whether
+	// or not the visit succeeded, and Events is invoked with what happened to
+	// each entry when not nil.
+	Progress func(Progress)
+	Events   func(Event)
+
+	Logger Logger
+}
+
+// Visitor receives the entries decoded from a stream.
+type Visitor interface {
+	// Visit is invoked with each entry in the order they appear in the
+	// stream, where the entries in a directory are visited after the
+	// directory itself. The contents of a regular file are decompressed and
+	// verified against its hash before the first byte is read from contents,
+	// which is only valid until Visit returns. Errors are reported to the
+	// Logger as warnings, and do not stop the rest of the stream from being
+	// decoded.
+	Visit(entry *Entry, contents io.Reader) error
+
+	// Ascend is invoked after every entry in the directory has been visited,
+	// with the modification time the directory should have once its entries
+	// have been created.
+	Ascend(dir *Entry) error
+}
+
+// HeaderVisitor is implemented by a Visitor that needs the stream header,
+// which is given to it before any entry is visited.
+type HeaderVisitor interface {
+	VisitHeader(Header) error
+}
+
+// Decoder reads a stream, and invokes a Visitor with each of its entries.
+type Decoder struct {
+	opts   DecoderOptions
+	log    Logger
+	header Header
+	rw     *rewriter
+
+	// An archive file with an index may have only its selected entries read
+	// from ra, in which case br is nil.
+	ra    io.ReaderAt
+	index Index
+	br    *bufio.Reader
+
+	haveHeader   bool
+	totals       *streamTotals
+	trailer      []byte
+	trailerErr   error
+	signatureErr error
+
+	visitor     Visitor
+	progress    Progress
+	stats       Stats
+	dirs        []decodeDir
+	selectDirs  []*selectDir
+	fileScratch *bytes.Buffer
+}
+
+// decodeDir is a directory the stream has descended into.
+type decodeDir struct {
+	entry *Entry
+	skip  bool // true when the entries in the directory are not visited
+}
+
+// NewDecoder reads the header of the stream from r, decrypting it when it is
+// encrypted, and returns a Decoder of the rest of the stream. When r is an
+// archive file with an index, or another io.ReaderAt with a size, and its
+// signature need not be verified, its index is read as well, and only the
+// messages of the selected entries are decoded.
+func NewDecoder(r io.Reader, opts DecoderOptions) (*Decoder, error) {
+	log := loggerOrNop(opts.Logger)
+	d := &Decoder{
+		opts:         opts,
+		log:          log,
+		rw:           opts.Rewriter.start(log),
+		totals:       newStreamTotals(),
+		trailerErr:   errTrailerNotReceived,
+		signatureErr: errSignatureNotReceived,
+		fileScratch:  new(bytes.Buffer),
+	}
+
+	if ra, ok := r.(io.ReaderAt); ok && opts.VerifyKey == nil {
+		if size, ok := readerSize(r); ok {
+			ix, err := ReadIndex(ra, size)
+			if err != nil && err != ErrNoIndex {
+				return nil, err
+			}
+			if err == nil {
+				log.Debugf("read index: %d entries\n", len(ix))
+				d.ra, d.index = ra, ix
+			}
+		}
+	}
+
+	if d.index != nil && opts.Select != nil {
+		// Only the messages of the selected entries are decoded, and the
+		// stream is verified by Decode afterwards.
+		mt, payload, _, err := MessageAt(d.ra, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read header")
+		}
+		if mt != MessageSyn {
+			return nil, errors.Errorf("cannot read header: stream begins with message type %d", mt)
+		}
+		if err = d.decodeHeader(payload); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	plaintext, err := maybeDecrypt(r, opts.Secret)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	if d.br, ok = plaintext.(*bufio.Reader); !ok {
+		d.br = bufio.NewReader(plaintext)
+	}
+	if err = d.readHeader(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readHeader reads the header message, which must begin the stream.
+func (d *Decoder) readHeader() error {
+	var mt, size gobsp.UVWI
+	if err := mt.UnmarshalBinaryFrom(d.br); err != nil {
+		return errors.Wrap(err, "cannot read header")
+	}
+	if err := size.UnmarshalBinaryFrom(d.br); err != nil {
+		return errors.Wrap(err, "cannot read header")
+	}
+	if gobsp.MessageType(mt) != MessageSyn {
+		return errors.Errorf("cannot read header: stream begins with message type %d", mt)
+	}
+	return d.digesting(MessageSyn, d.decodeHeader)(io.LimitReader(d.br, int64(size)))
+}
+
+func (d *Decoder) decodeHeader(r io.Reader) error {
+	d.log.Debugf("decode header\n")
+	if d.haveHeader {
+		return errors.New("cannot decode header: received more than once")
+	}
+	if err := d.header.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode header")
+	}
+	d.haveHeader = true
+	d.log.Debugf("compress: %s; hash: %s\n", d.header.Codec, d.header.Hash)
+	return nil
+}
+
+// Header returns the header of the stream.
+func (d *Decoder) Header() Header { return d.header }
+
+// Index returns the index of the archive, or nil when the archive has no
+// index, or when it was not read because the stream must be verified.
+func (d *Decoder) Index() Index { return d.index }
+
+// Stats returns the counts of the entries visited so far, and of those that
+// were skipped or could not be visited.
+func (d *Decoder) Stats() Stats { return d.stats }
+
+// Decode invokes v with each entry of the stream. Errors from individual
+// entries and messages are reported to the Logger as warnings, and as failed
+// Events, and Decode returns nil when the stream ended with a matching
+// trailer, and when requested, a valid signature. When only the selected
+// entries of an archive file with an index are decoded, the rest of the
+// archive is read without decoding it to verify the trailer. Decode may only
+// be invoked once.
+func (d *Decoder) Decode(v Visitor) error {
+	if d.visitor != nil {
+		return errors.New("cannot decode: stream already decoded")
+	}
+	d.visitor = v
+	if hv, ok := v.(HeaderVisitor); ok {
+		if err := hv.VisitHeader(d.header); err != nil {
+			return err
+		}
+	}
+
+	entryHandlers := d.entryHandlers()
+	if d.rw != nil {
+		entryHandlers = d.rw.rewriting(entryHandlers)
+	}
+	if d.opts.Select != nil {
+		entryHandlers = d.selecting(d.opts.Select, entryHandlers)
+	}
+
+	if d.br == nil {
+		handlers := make(map[uint32]gobsp.MessageHandler, len(entryHandlers))
+		for messageType, handler := range entryHandlers {
+			handlers[uint32(messageType)] = handler
+		}
+		if err := d.scan(d.indexedMessages(), handlers); err != nil {
+			return err
+		}
+		return d.verifyArchive()
+	}
+
+	handlers := map[uint32]gobsp.MessageHandler{
+		uint32(MessageSyn):       d.digesting(MessageSyn, d.decodeHeader),
+		uint32(MessageIndex):     d.digesting(MessageIndex, gobsp.DiscardAll),
+		uint32(MessageTrailer):   d.decodeTrailer,
+		uint32(MessageSignature): d.decodeSignature,
+		uint32(MessageFooter):    gobsp.DiscardAll, // follows trailer, so not digested
+	}
+	for messageType, handler := range entryHandlers {
+		handlers[uint32(messageType)] = d.digesting(messageType, handler)
+	}
+
+	// Errors from individual entries have already been reported, but the
+	// stream itself must have ended with a matching trailer, and when
+	// requested, a valid signature.
+	if err := d.scan(d.br, handlers); err != nil {
+		return err
+	}
+	return d.verified()
+}
+
+// scan invokes the handler for each message read from r, reporting errors
+// from individual messages as warnings. Errors from messages that were not
+// already reported as failed entries, such as messages that could not be
+// decoded, are reported as failures of entries with an empty path.
+func (d *Decoder) scan(r io.Reader, handlers map[uint32]gobsp.MessageHandler) error {
+	scanner, err := gobsp.NewScanner(r, gobsp.Handlers(handlers))
+	if err != nil {
+		return err
+	}
+	for scanner.Scan() {
+		failed := d.stats.Failed
+		if err = scanner.Handle(); err != nil {
+			d.log.Warningf("%s\n", err)
+			if d.stats.Failed == failed {
+				d.failed(&Entry{Mode: fs.ModeIrregular}, 0, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// entryHandlers returns message handlers that decode each entry and invoke
+// the visitor with it.
+func (d *Decoder) entryHandlers() map[gobsp.MessageType]gobsp.MessageHandler {
+	handlers := map[gobsp.MessageType]gobsp.MessageHandler{
+		MessageDirectoryAscend: d.decodeAscend,
+	}
+	for messageType := range entryModeTypes {
+		messageType := messageType
+		handlers[messageType] = func(r io.Reader) error {
+			return d.decodeEntry(r, messageType)
+		}
+	}
+	return handlers
+}
+
+func (d *Decoder) decodeEntry(r io.Reader, messageType gobsp.MessageType) error {
+	entry, err := unmarshalEntry(r, messageType)
+	if err != nil {
+		d.failed(&Entry{Mode: entryModeTypes[messageType]}, 0, err)
+		return err
+	}
+
+	name := entry.Path
+	var parent string
+	var skip bool
+	if n := len(d.dirs); n > 0 {
+		parent, skip = d.dirs[n-1].entry.Path, d.dirs[n-1].skip
+	}
+	entry.Path = path.Join(parent, name)
+
+	// A name that is not a single path component could refer to an entry
+	// outside of its directory.
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+		err = errors.Errorf("cannot decode entry: invalid name: %q", name)
+		d.failed(entry, 0, err)
+		skip = true
+	}
+
+	if messageType == MessageDirectoryDescend {
+		// Always descend, even when the directory is skipped or visit fails,
+		// so the paths of remaining entries are correct.
+		d.dirs = append(d.dirs, decodeDir{entry: entry, skip: skip})
+	}
+	if skip {
+		return err
+	}
+
+	d.log.Debugf("%s decode %s\n", entry.Path, entry.Mode.Type())
+	var contents io.Reader
+	if messageType == MessageRegularFile {
+		contents = &fileContents{d: d, r: r, entry: entry}
+	}
+	start := time.Now()
+	if err = d.visitor.Visit(entry, contents); err != nil {
+		d.failed(entry, time.Since(start), err)
+	} else {
+		d.stats.count(entry)
+		d.event(Event{Path: entry.Path, Mode: entry.Mode, Action: ActionDecoded, Size: entry.Size, Duration: time.Since(start)})
+	}
+	d.progress.add(entry)
+	if d.opts.Progress != nil {
+		d.opts.Progress(d.progress)
+	}
+	return err
+}
+
+func (d *Decoder) decodeAscend(r io.Reader) error {
+	if len(d.dirs) == 0 {
+		return errors.New("cannot ascend above stream root")
+	}
+	dir := d.dirs[len(d.dirs)-1]
+	d.dirs = d.dirs[:len(d.dirs)-1]
+
+	var mtime gobsp.Int64
+	if err := mtime.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode modification time")
+	}
+	if dir.skip {
+		return nil
+	}
+	ascended := *dir.entry
+	ascended.ModTime = time.Unix(int64(mtime), 0)
+	if err := d.visitor.Ascend(&ascended); err != nil {
+		d.failed(&ascended, 0, err)
+		return err
+	}
+	return nil
+}
+
+// fileContents reads the contents of a regular file from the remainder of its
+// message. The contents are decompressed and verified against the hash of
+// the entry when first read.
+type fileContents struct {
+	d        *Decoder
+	r        io.Reader
+	entry    *Entry
+	contents *bytes.Reader
+	err      error
+}
+
+// load decompresses and verifies the contents.
+func (fc *fileContents) load() error {
+	if fc.contents != nil || fc.err != nil {
+		return fc.err
+	}
+	fc.err = fc.d.decodeContents(fc.r, fc.entry)
+	if fc.err == nil {
+		fc.contents = bytes.NewReader(fc.d.fileScratch.Bytes())
+	}
+	return fc.err
+}
+
+func (fc *fileContents) Read(p []byte) (int, error) {
+	if err := fc.load(); err != nil {
+		return 0, err
+	}
+	return fc.contents.Read(p)
+}
+
+func (fc *fileContents) WriteTo(w io.Writer) (int64, error) {
+	if err := fc.load(); err != nil {
+		return 0, err
+	}
+	return fc.contents.WriteTo(w)
+}
+
+// maxPrealloc limits the memory allocated for the contents of a file before
+// they are read, because the size was read from the stream.
+const maxPrealloc = 16 << 20
+
+func preallocSize(size int64) int {
+	if size < 0 || size > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(size)
+}
+
+// decodeContents reads the codec and the contents encoded with it into
+// fileScratch, and verifies them against the size and hash of the entry.
+func (d *Decoder) decodeContents(r io.Reader, entry *Entry) error {
+	var fileCodec gobsp.Uint8
+	if err := fileCodec.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode codec")
+	}
+	if entry.Size < 0 {
+		return errors.Errorf("cannot decode contents: invalid size: %d", entry.Size)
+	}
+	if Codec(fileCodec) == codecReferenced {
+		return errors.Wrapf(ErrContentsNotSent, "%s:%x", d.header.Hash, entry.Hash)
+	}
+	d.fileScratch.Reset()
+	d.fileScratch.Grow(preallocSize(entry.Size))
+	if err := Codec(fileCodec).Decompress(d.fileScratch, r, entry.Size); err != nil {
+		return errors.Wrapf(err, "cannot decompress contents: %s", Codec(fileCodec))
+	}
+	if int64(d.fileScratch.Len()) < entry.Size {
+		return errors.Wrapf(io.ErrUnexpectedEOF, "read fewer than expected bytes: %d < %d", d.fileScratch.Len(), entry.Size)
+	}
+	sum := d.header.Hash.Sum(d.fileScratch.Bytes())
+	if !bytes.Equal(entry.Hash, sum) {
+		d.stats.HashMismatches++
+		return errors.Wrapf(ErrHashMismatch, "%s %x != %x", d.header.Hash, entry.Hash, sum)
+	}
+	return nil
+}
+
+// indexedMessages returns a stream of the message of each selected entry,
+// and the directory messages needed to visit them in their directories, read
+// directly from the archive at the offsets in the index. The stream has no
+// header or trailer.
+func (d *Decoder) indexedMessages() io.Reader {
+	var readers []io.Reader
+
+	// dirs is the stack of directories containing the next entry. Directory
+	// messages are only sent when a selected entry is in or below them, and
+	// each one sent is followed by an ascend message when leaving it.
+	type indexedDir struct {
+		entry IndexEntry
+		sent  bool
+	}
+	var dirs []*indexedDir
+
+	message := func(offset int64) {
+		readers = append(readers, &messageReader{ra: d.ra, offset: offset})
+	}
+	ascend := func(dir *indexedDir) {
+		if !dir.sent {
+			return
+		}
+		buf := new(bytes.Buffer)
+		_ = gobsp.UVWI(MessageDirectoryAscend).MarshalBinaryTo(buf) // bytes.Buffer never returns error
+		mtime := new(bytes.Buffer)
+		_ = gobsp.Int64(dir.entry.ModTime.Unix()).MarshalBinaryTo(mtime)
+		_ = gobsp.UVWI(mtime.Len()).MarshalBinaryTo(buf)
+		_, _ = buf.Write(mtime.Bytes())
+		readers = append(readers, buf)
+	}
+
+	for _, ie := range d.index {
+		parent := path.Dir(ie.Path)
+		for len(dirs) > 0 && dirs[len(dirs)-1].entry.Path != parent {
+			ascend(dirs[len(dirs)-1])
+			dirs = dirs[:len(dirs)-1]
+		}
+		if len(dirs) == 0 && parent != "." {
+			d.log.Warningf("cannot read index: entry outside of directory: %s\n", ie.Path)
+			continue
+		}
+
+		var dir *indexedDir
+		if ie.Mode.IsDir() {
+			dir = &indexedDir{entry: ie}
+		}
+		if d.opts.Select(ie.Path) {
+			for _, ancestor := range dirs {
+				if !ancestor.sent {
+					message(ancestor.entry.Offset)
+					ancestor.sent = true
+				}
+			}
+			message(ie.Offset)
+			if dir != nil {
+				dir.sent = true
+			}
+		} else if dir == nil {
+			d.skipped(ie.Path, ie.Mode, ie.Size)
+		}
+		if dir != nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		ascend(dirs[i])
+	}
+
+	return io.MultiReader(readers...)
+}
+
+// messageReader reads the entire message that begins at offset in ra, which
+// is only located when first read.
+type messageReader struct {
+	ra     io.ReaderAt
+	offset int64
+	sr     *io.SectionReader
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	if mr.sr == nil {
+		_, _, length, err := MessageAt(mr.ra, mr.offset)
+		if err != nil {
+			return 0, err
+		}
+		mr.sr = io.NewSectionReader(mr.ra, mr.offset, length)
+	}
+	return mr.sr.Read(p)
+}
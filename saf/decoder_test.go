@@ -0,0 +1,206 @@
+package saf
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karrick/gobsp"
+)
+
+// encodeEntries returns a stream of the entries added by AddEntry, where
+// regular files contain their own path.
+func encodeEntries(t *testing.T, opts EncoderOptions, paths ...string) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	e, err := NewEncoder(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1600000000, 0)
+	for _, p := range paths {
+		entry := &Entry{Path: p, Mode: 0644, ModTime: mtime}
+		var contents io.Reader
+		switch {
+		case strings.HasSuffix(p, "/"):
+			entry.Mode = fs.ModeDir | 0755
+		case strings.HasSuffix(p, "|"):
+			entry.Path, entry.Mode = strings.TrimSuffix(p, "|"), fs.ModeNamedPipe|0644
+		default:
+			entry.Size = int64(len(p))
+			contents = strings.NewReader(p)
+		}
+		if err = e.AddEntry(entry, contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// recorder is a Visitor that records the path of each entry, with a trailing
+// slash for directories, and ".." for each ascend.
+type recorder struct {
+	paths []string
+}
+
+func (rec *recorder) Visit(entry *Entry, contents io.Reader) error {
+	p := entry.Path
+	if entry.Mode.IsDir() {
+		p += "/"
+	}
+	if entry.Mode.IsRegular() {
+		buf, err := ioutil.ReadAll(contents)
+		if err != nil {
+			return err
+		}
+		if string(buf) != entry.Path {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	rec.paths = append(rec.paths, p)
+	return nil
+}
+
+func (rec *recorder) Ascend(*Entry) error {
+	rec.paths = append(rec.paths, "..")
+	return nil
+}
+
+func decodeEntries(t *testing.T, r io.Reader, opts DecoderOptions) (string, error) {
+	t.Helper()
+	d, err := NewDecoder(r, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := new(recorder)
+	err = d.Decode(rec)
+	return strings.Join(rec.paths, ","), err
+}
+
+func TestDecoderRoundTrip(t *testing.T) {
+	stream := encodeEntries(t, EncoderOptions{Codec: CodecGzip}, "a/", "a/p|", "a/b/q", "c/r")
+
+	got, err := decodeEntries(t, bytes.NewBuffer(stream), DecoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a/,a/p,a/b/,a/b/q,..,..,c/,c/r,.."; got != want {
+		t.Errorf("GOT: %s; WANT: %s", got, want)
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		_, err := decodeEntries(t, bytes.NewBuffer(stream[:len(stream)-20]), DecoderOptions{})
+		if err == nil {
+			t.Errorf("GOT: nil; WANT: error")
+		}
+	})
+}
+
+func TestDecoderIndexedSelect(t *testing.T) {
+	stream := encodeEntries(t, EncoderOptions{Index: true}, "a/p|", "a/b/q|", "c/r|")
+
+	selected := func(pathname string) bool { return pathname == "a/b/q" }
+	got, err := decodeEntries(t, bytes.NewReader(stream), DecoderOptions{Select: selected})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a/,a/b/,a/b/q,..,.."; got != want {
+		t.Errorf("GOT: %s; WANT: %s", got, want)
+	}
+
+	// Damage to entries that are not selected is still detected.
+	damaged := append([]byte(nil), stream...)
+	damaged[bytes.Index(damaged, []byte("c/r"))] ^= 0xff
+	if _, err = decodeEntries(t, bytes.NewReader(damaged), DecoderOptions{Select: selected}); err == nil {
+		t.Errorf("GOT: nil; WANT: error")
+	}
+}
+
+func TestDecoderSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("embedded", func(t *testing.T) {
+		stream := encodeEntries(t, EncoderOptions{SignKey: private}, "a/b")
+		if _, err := decodeEntries(t, bytes.NewReader(stream), DecoderOptions{VerifyKey: public}); err != nil {
+			t.Errorf("GOT: %v; WANT: nil", err)
+		}
+		if _, err := decodeEntries(t, bytes.NewReader(stream), DecoderOptions{VerifyKey: other}); err == nil {
+			t.Errorf("GOT: nil; WANT: error")
+		}
+	})
+
+	t.Run("detached", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		e, err := NewEncoder(buf, EncoderOptions{SignKey: private, DetachSignature: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		signature := e.Signature()
+
+		if _, err := decodeEntries(t, bytes.NewReader(buf.Bytes()), DecoderOptions{VerifyKey: public, Signature: signature}); err != nil {
+			t.Errorf("GOT: %v; WANT: nil", err)
+		}
+		if _, err := decodeEntries(t, bytes.NewReader(buf.Bytes()), DecoderOptions{VerifyKey: public}); err == nil {
+			t.Errorf("GOT: nil; WANT: error")
+		}
+	})
+}
+
+func TestDecoderMessageFailure(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e, err := NewEncoder(buf, EncoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddEntry(&Entry{Path: "a", Mode: 0644, ModTime: time.Unix(1600000000, 0), Size: 1}, strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	// An ascend without a matching descend cannot be decoded.
+	ascend := new(bytes.Buffer)
+	if err = gobsp.Int64(1600000000).MarshalBinaryTo(ascend); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.compose(MessageDirectoryAscend, ascend.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var failed []Event
+	d, err := NewDecoder(buf, DecoderOptions{Events: func(ev Event) {
+		if ev.Action == ActionFailed {
+			failed = append(failed, ev)
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Decode(NewExtractor(NewMemorySink(), ExtractorOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Path != "" || failed[0].Err == nil {
+		t.Errorf("GOT: %+v; WANT: 1 failure without path", failed)
+	}
+	if got := d.Stats().Failed; got != 1 {
+		t.Errorf("GOT: %d; WANT: 1", got)
+	}
+}
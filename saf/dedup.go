@@ -0,0 +1,358 @@
+package saf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dedup identifies how a DedupSink creates a regular file from a file already
+// in the destination with the same contents.
+type Dedup uint8
+
+const (
+	DedupNone    Dedup = iota // 0 always write the contents
+	DedupReflink              // 1 clone the existing file, or copy it
+	DedupLink                 // 2 hard link the existing file, or clone or copy it
+)
+
+// ParseDedup returns the deduplication with the specified name: none,
+// reflink, or link.
+func ParseDedup(name string) (Dedup, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return DedupNone, nil
+	case "reflink":
+		return DedupReflink, nil
+	case "link":
+		return DedupLink, nil
+	}
+	return DedupNone, errors.Errorf("unknown deduplication: %q", name)
+}
+
+func (d Dedup) String() string {
+	switch d {
+	case DedupNone:
+		return "none"
+	case DedupReflink:
+		return "reflink"
+	case DedupLink:
+		return "link"
+	}
+	return "dedup(" + strconv.Itoa(int(d)) + ")"
+}
+
+// ContentLinker is implemented by a Sink that can create a regular file from
+// contents it already has, rather than writing the contents from the stream.
+type ContentLinker interface {
+	// LinkFile creates the regular file from existing contents whose hash,
+	// calculated with the specified algorithm, is entry.Hash. It returns
+	// false without creating the file when there are none.
+	LinkFile(entry *Entry, hash HashAlgorithm) (bool, error)
+}
+
+// DedupSink is a DirSink that keeps an index of the hashes of the regular
+// files below its directory, so a regular file whose contents are already in
+// the directory, such as one that was moved, is cloned from the existing file
+// or hard linked to it rather than written again. Files are cloned with
+// FICLONE on Linux file systems that support it, and are otherwise copied
+// from the existing file. A file is only hard linked when the existing file
+// already has its permissions and modification time, because they are
+// shared by every link. A file that was linked, or that has other links, is
+// replaced rather than written over, so a change to one link does not change
+// the others. Files are only linked when changes are not deferred, or when
+// deferred changes are committed.
+//
+// The index is built by hashing every regular file below the directory when
+// the first regular file is created. When it is saved to a file, only the
+// files whose size or modification time changed are hashed again the next
+// time. A file whose contents change without changing either is not noticed.
+// The hashes in the index may be sent to the sender with KnownHashes, so the
+// contents of files already in the directory are not sent at all.
+type DedupSink struct {
+	DirSink
+	dedup     Dedup
+	indexFile string
+	log       Logger
+
+	hash  HashAlgorithm
+	files map[string]indexedFile // by slash separated path below the directory
+	sums  map[string][]string    // paths of files by hash, which may be stale
+
+	// created holds the hashes of the regular files being created, which
+	// are indexed once their modification time is set.
+	created map[string][]byte
+
+	// linked holds the paths of the regular files that were hard linked,
+	// which are removed before being written, because their link count is
+	// not known on every platform.
+	linked map[string]struct{}
+}
+
+// indexedFile is the hash of a regular file, along with the size and
+// modification time it had when it was hashed.
+type indexedFile struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // nanoseconds since the epoch
+	Sum     []byte `json:"sum"`
+}
+
+// savedIndex is the index written to the index file.
+type savedIndex struct {
+	Hash  string                 `json:"hash"`
+	Files map[string]indexedFile `json:"files"`
+}
+
+// NewDedupSink returns a DedupSink that creates entries below root. When
+// indexFile is not empty, the index is read from it, and saved to it by
+// Save.
+func NewDedupSink(root string, dedup Dedup, indexFile string, log Logger) *DedupSink {
+	return &DedupSink{
+		DirSink:   DirSink(root),
+		dedup:     dedup,
+		indexFile: indexFile,
+		log:       loggerOrNop(log),
+		created:   make(map[string][]byte),
+		linked:    make(map[string]struct{}),
+	}
+}
+
+// LinkFile creates the regular file by linking, cloning, or copying an
+// existing file with the same hash. When the file already has the same
+// contents, it is left alone.
+func (s *DedupSink) LinkFile(entry *Entry, hash HashAlgorithm) (bool, error) {
+	if s.dedup == DedupNone || entry.Size == 0 {
+		return false, nil
+	}
+	if s.files == nil || s.hash != hash {
+		s.buildIndex(hash)
+	}
+	s.created[entry.Path] = entry.Hash
+
+	existing, fi := s.lookup(entry.Hash, entry.Size)
+	if fi == nil {
+		return false, nil
+	}
+	pathname := s.path(entry.Path)
+
+	if li, err := os.Lstat(pathname); err == nil && os.SameFile(fi, li) {
+		if fi.Mode().Perm() == entry.Mode.Perm() && fi.ModTime().Equal(entry.ModTime) {
+			s.log.Debugf("%s unchanged\n", pathname)
+			return true, nil
+		}
+		// Setting the metadata of the file would change every link to it,
+		// so it is replaced by a clone.
+	}
+	if strings.HasPrefix(existing, pathname+string(filepath.Separator)) {
+		return false, nil // removed when replacing the directory at pathname
+	}
+	if err := removeUnlessType(pathname, os.FileMode.IsRegular); err != nil {
+		return false, err
+	}
+
+	if s.dedup == DedupLink && fi.Mode().Perm() == entry.Mode.Perm() && fi.ModTime().Equal(entry.ModTime) {
+		if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+			return false, errors.WithStack(err)
+		}
+		err := os.Link(existing, pathname)
+		if err == nil {
+			s.log.Debugf("%s linked to %s\n", pathname, existing)
+			s.linked[entry.Path] = struct{}{}
+			return true, nil
+		}
+		s.log.Debugf("%s cannot link: %s\n", pathname, err)
+	}
+	delete(s.linked, entry.Path)
+	return true, s.cloneFile(existing, pathname)
+}
+
+// CreateFile writes contents to the regular file, removing it first when it
+// was hard linked.
+func (s *DedupSink) CreateFile(pathname string, contents io.Reader) error {
+	if _, ok := s.linked[pathname]; ok {
+		delete(s.linked, pathname)
+		if err := os.Remove(s.path(pathname)); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	return s.DirSink.CreateFile(pathname, contents)
+}
+
+// cloneFile clones the existing file to a temporary file, or when the file
+// system cannot clone it, copies it, then renames the temporary file to
+// pathname. The file at pathname is never written over, because it may be
+// the existing file, or another link to it.
+func (s *DedupSink) cloneFile(existing, pathname string) error {
+	src, err := os.Open(existing)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { _ = src.Close() }() // only read
+
+	dst, err := ioutil.TempFile(filepath.Dir(pathname), ".tsync-clone-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = clone(dst, src); err == nil {
+		s.log.Debugf("%s cloned from %s\n", pathname, existing)
+	} else {
+		s.log.Debugf("%s cannot clone: %s\n", pathname, err)
+		_, err = io.Copy(dst, src)
+	}
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), pathname)
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name()) // ignore secondary error
+	}
+	return errors.WithStack(err)
+}
+
+// SetMetadata sets the permissions and modification time, and indexes a
+// regular file that was created.
+func (s *DedupSink) SetMetadata(pathname string, mode fs.FileMode, mtime time.Time) error {
+	if err := s.DirSink.SetMetadata(pathname, mode, mtime); err != nil {
+		return err
+	}
+	if sum, ok := s.created[pathname]; ok {
+		delete(s.created, pathname)
+		if fi, err := os.Lstat(s.path(pathname)); err == nil {
+			s.index(pathname, fi, sum)
+		}
+	}
+	return nil
+}
+
+// lookup returns the name and information of an indexed regular file with
+// the hash and size, which has not changed since it was indexed.
+func (s *DedupSink) lookup(sum []byte, size int64) (string, os.FileInfo) {
+	for _, name := range s.sums[string(sum)] {
+		f, ok := s.files[name]
+		if !ok || f.Size != size || !bytes.Equal(f.Sum, sum) {
+			continue // indexed again with other contents
+		}
+		pathname := s.path(name)
+		fi, err := os.Lstat(pathname)
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() != f.Size || fi.ModTime().UnixNano() != f.ModTime {
+			continue
+		}
+		return pathname, fi
+	}
+	return "", nil
+}
+
+func (s *DedupSink) index(name string, fi os.FileInfo, sum []byte) {
+	s.files[name] = indexedFile{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Sum: sum}
+	s.sums[string(sum)] = append(s.sums[string(sum)], name)
+}
+
+// buildIndex hashes every regular file below the directory with the
+// algorithm, except those whose hash was saved in the index file, and that
+// have not changed since.
+func (s *DedupSink) buildIndex(hash HashAlgorithm) {
+	s.hash = hash
+	s.files = make(map[string]indexedFile)
+	s.sums = make(map[string][]string)
+
+	var saved savedIndex
+	if s.indexFile != "" {
+		buf, err := ioutil.ReadFile(s.indexFile)
+		if err == nil {
+			err = json.Unmarshal(buf, &saved)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			s.log.Warningf("cannot read index file: %s\n", err)
+		}
+		if saved.Hash != hash.String() {
+			saved.Files = nil // hashes cannot be compared
+		}
+	}
+	indexFile, _ := filepath.Abs(s.indexFile)
+
+	root := string(s.DirSink)
+	var hashed int
+	err := filepath.Walk(root, func(pathname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			s.log.Warningf("%s\n", err)
+			return nil
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 || pathname == indexFile || strings.HasPrefix(fi.Name(), ".tsync-") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, pathname)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if f, ok := saved.Files[name]; ok && f.Size == fi.Size() && f.ModTime == fi.ModTime().UnixNano() {
+			s.index(name, fi, f.Sum)
+			return nil
+		}
+		buf, err := ioutil.ReadFile(pathname)
+		if err != nil {
+			s.log.Warningf("%s\n", err)
+			return nil
+		}
+		s.index(name, fi, hash.Sum(buf))
+		hashed++
+		return nil
+	})
+	if err != nil {
+		s.log.Warningf("cannot index %s: %s\n", root, err)
+	}
+	s.log.Verbosef("%s indexed %d files, hashed %d\n", root, len(s.files), hashed)
+}
+
+// KnownHashes returns the hashes, calculated with the algorithm, of the
+// regular files below the directory, which a sender may send as references
+// rather than contents. The index is built when it was not already built
+// with the algorithm.
+func (s *DedupSink) KnownHashes(hash HashAlgorithm) *KnownHashes {
+	if s.files == nil || s.hash != hash {
+		s.buildIndex(hash)
+	}
+	k := NewKnownHashes(hash)
+	for _, f := range s.files {
+		k.Add(f.Sum)
+	}
+	return k
+}
+
+// Save writes the index to the index file, unless it was never built.
+func (s *DedupSink) Save() error {
+	if s.indexFile == "" || s.files == nil {
+		return nil
+	}
+	buf, err := json.Marshal(savedIndex{Hash: s.hash.String(), Files: s.files})
+	if err != nil {
+		return errors.Wrap(err, "cannot encode index")
+	}
+	fh, err := ioutil.TempFile(filepath.Dir(s.indexFile), ".tsync-index-")
+	if err != nil {
+		return errors.Wrap(err, "cannot write index")
+	}
+	_, err = fh.Write(buf)
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), s.indexFile)
+	}
+	if err != nil {
+		_ = os.Remove(fh.Name()) // ignore secondary error
+		return errors.Wrap(err, "cannot write index")
+	}
+	return nil
+}
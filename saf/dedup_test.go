@@ -0,0 +1,187 @@
+package saf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupSink(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	stream := new(bytes.Buffer)
+	e, err := NewEncoder(stream, EncoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"top/a", "top/b"} {
+		err = e.AddEntry(&Entry{Path: name, Mode: 0644, ModTime: mtime, Size: 8}, strings.NewReader("contents"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	extract := func(t *testing.T, sink Sink) {
+		t.Helper()
+		d, err := NewDecoder(bytes.NewReader(stream.Bytes()), DecoderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = d.Decode(NewExtractor(sink, ExtractorOptions{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dedup := range []Dedup{DedupLink, DedupReflink} {
+		t.Run(dedup.String(), func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.Mkdir(filepath.Join(root, "top"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			moved := filepath.Join(root, "moved")
+			if err := ioutil.WriteFile(moved, []byte("contents"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(moved, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			indexFile := filepath.Join(t.TempDir(), "index")
+
+			sink := NewDedupSink(root, dedup, indexFile, nil)
+			extract(t, sink)
+			if err := sink.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			mi, err := os.Stat(moved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"a", "b"} {
+				pathname := filepath.Join(root, "top", name)
+				got, err := ioutil.ReadFile(pathname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != "contents" {
+					t.Errorf("%s: GOT: %q; WANT: %q", name, got, "contents")
+				}
+				fi, err := os.Stat(pathname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if linked := os.SameFile(mi, fi); linked != (dedup == DedupLink) {
+					t.Errorf("%s: GOT: linked %t; WANT: %t", name, linked, !linked)
+				}
+			}
+
+			// The saved index is used by the next extraction.
+			buf, err := ioutil.ReadFile(indexFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{`"moved"`, `"top/a"`, `"top/b"`} {
+				if !bytes.Contains(buf, []byte(name)) {
+					t.Errorf("GOT: %s; WANT: %s", buf, name)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupSinkSharedFiles(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	later := mtime.Add(time.Hour)
+
+	cases := []struct {
+		name     string
+		contents string
+		mtime    time.Time
+	}{
+		{"changed contents", "new", mtime},
+		{"changed mtime", "old", later},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// The destination has z/x, which was copied to a/y by the
+			// sender before z/x changed.
+			stream := new(bytes.Buffer)
+			e, err := NewEncoder(stream, EncoderOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = e.AddEntry(&Entry{Path: "a/y", Mode: 0644, ModTime: mtime, Size: 3}, strings.NewReader("old"))
+			if err == nil {
+				err = e.AddEntry(&Entry{Path: "z/x", Mode: 0644, ModTime: c.mtime, Size: int64(len(c.contents))}, strings.NewReader(c.contents))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = e.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			root := t.TempDir()
+			for _, name := range []string{"a", "z"} {
+				if err := os.Mkdir(filepath.Join(root, name), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			x := filepath.Join(root, "z", "x")
+			if err := ioutil.WriteFile(x, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(x, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := NewDecoder(bytes.NewReader(stream.Bytes()), DecoderOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = d.Decode(NewExtractor(NewDedupSink(root, DedupLink, "", nil), ExtractorOptions{})); err != nil {
+				t.Fatal(err)
+			}
+
+			y := filepath.Join(root, "a", "y")
+			for pathname, want := range map[string]struct {
+				contents string
+				mtime    time.Time
+			}{y: {"old", mtime}, x: {c.contents, c.mtime}} {
+				got, err := ioutil.ReadFile(pathname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want.contents {
+					t.Errorf("%s: GOT: %q; WANT: %q", pathname, got, want.contents)
+				}
+				fi, err := os.Stat(pathname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !fi.ModTime().Equal(want.mtime) {
+					t.Errorf("%s: GOT: %s; WANT: %s", pathname, fi.ModTime(), want.mtime)
+				}
+			}
+
+			yi, err := os.Stat(y)
+			if err != nil {
+				t.Fatal(err)
+			}
+			xi, err := os.Stat(x)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if os.SameFile(xi, yi) {
+				t.Errorf("GOT: linked; WANT: separate files")
+			}
+		})
+	}
+}
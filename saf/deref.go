@@ -0,0 +1,92 @@
+package saf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Dereference determines which symlinks below a path added to an Encoder are
+// encoded as their referent rather than as a symlink.
+type Dereference uint8
+
+const (
+	// DereferenceNone encodes every symlink as a symlink.
+	DereferenceNone Dereference = iota
+
+	// DereferenceAll encodes every symlink as its referent.
+	DereferenceAll
+
+	// DereferenceArgs only encodes a symlink as its referent when it is the
+	// path added to the Encoder.
+	DereferenceArgs
+
+	// DereferenceUnsafe only encodes a symlink as its referent when the
+	// referent is absolute or outside the path added to the Encoder, so the
+	// stream is complete when extracted on another host.
+	DereferenceUnsafe
+)
+
+// dereference returns true when the symlink at targetFull, which is below the
+// target being encoded, should be encoded as its referent rather than as a
+// symlink.
+func (e *Encoder) dereference(targetFull string) (bool, error) {
+	switch e.opts.Dereference {
+	case DereferenceAll:
+		return true, nil
+	case DereferenceUnsafe:
+		linkname, err := os.Readlink(targetFull)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		return unsafeLink(e.targetRoot, targetFull, linkname), nil
+	}
+	return false, nil
+}
+
+// unsafeLink returns true when linkname, the referent of the symlink at
+// targetFull, is absolute or resolves outside targetRoot. Like rsync, this
+// only considers the referent itself, not other symlinks it may pass through.
+func unsafeLink(targetRoot, targetFull, linkname string) bool {
+	if filepath.IsAbs(linkname) {
+		return true
+	}
+	resolved := filepath.Join(filepath.Dir(targetFull), linkname)
+	return resolved != targetRoot && !strings.HasPrefix(resolved, targetRoot+string(filepath.Separator))
+}
+
+// referentType returns the file mode type of the referent of the symlink at
+// targetFull.
+func (e *Encoder) referentType(targetFull string) (os.FileMode, error) {
+	fi, err := os.Stat(targetFull)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot dereference symlink")
+	}
+	e.log.Debugf("%s dereference symlink\n", targetFull)
+	return fi.Mode() & os.ModeType, nil
+}
+
+type fileID struct {
+	dev, ino uint64
+}
+
+// enterDirectory returns an error when the directory at targetFull is already
+// being encoded. Otherwise it records the directory, and must be followed by
+// a call to leaveDirectory.
+func (e *Encoder) enterDirectory(targetFull string, fi os.FileInfo) error {
+	id := fileID{dev: device(fi), ino: inode(fi)}
+	if id.ino == 0 {
+		return nil // identity not available on this platform
+	}
+	if _, ok := e.encodingDirs[id]; ok {
+		return errors.Errorf("file system loop: %s", targetFull)
+	}
+	e.encodingDirs[id] = struct{}{}
+	return nil
+}
+
+func (e *Encoder) leaveDirectory(fi os.FileInfo) {
+	delete(e.encodingDirs, fileID{dev: device(fi), ino: inode(fi)})
+}
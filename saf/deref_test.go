@@ -0,0 +1,29 @@
+package saf
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUnsafeLink(t *testing.T) {
+	targetRoot := filepath.FromSlash("/src/tree")
+
+	cases := []struct {
+		link, linkname string
+		want           bool
+	}{
+		{"/src/tree/a", "b", false},
+		{"/src/tree/d/a", "../b", false},
+		{"/src/tree/d/a", "..", false},
+		{"/src/tree/a", "..", true},
+		{"/src/tree/a", "../tree2/b", true},
+		{"/src/tree/d/a", "../../other", true},
+		{"/src/tree/a", "/src/tree/b", true},
+	}
+
+	for _, c := range cases {
+		if got := unsafeLink(targetRoot, filepath.FromSlash(c.link), filepath.FromSlash(c.linkname)); got != c.want {
+			t.Errorf("%s -> %s: GOT: %v; WANT: %v", c.link, c.linkname, got, c.want)
+		}
+	}
+}
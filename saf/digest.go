@@ -0,0 +1,73 @@
+package saf
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/pkg/errors"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+// HashAlgorithm identifies the algorithm used to calculate the digest of the
+// contents of each regular file. The sender records the algorithm in the
+// stream header, and each regular file message carries the digest of its
+// contents, which the recipient verifies before writing the file.
+type HashAlgorithm uint8
+
+const (
+	HashXXH64   HashAlgorithm = iota // 0 64-bit xxhash, fast but only detects transport errors
+	HashXXH3128                      // 1 128-bit XXH3
+	HashSHA256                       // 2 SHA-256
+	HashBLAKE3                       // 3 256-bit BLAKE3
+)
+
+// ParseHashAlgorithm returns the algorithm with the specified name: xxhash64,
+// xxh3-128, sha256, or blake3.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	switch strings.ToLower(name) {
+	case "", "xxhash64":
+		return HashXXH64, nil
+	case "xxh3-128":
+		return HashXXH3128, nil
+	case "sha256":
+		return HashSHA256, nil
+	case "blake3":
+		return HashBLAKE3, nil
+	}
+	return HashXXH64, errors.Errorf("unknown hash algorithm: %q", name)
+}
+
+func (h HashAlgorithm) String() string {
+	switch h {
+	case HashXXH64:
+		return "xxhash64"
+	case HashXXH3128:
+		return "xxh3-128"
+	case HashSHA256:
+		return "sha256"
+	case HashBLAKE3:
+		return "blake3"
+	}
+	return "hash(" + strconv.Itoa(int(h)) + ")"
+}
+
+// Sum returns the digest of buf.
+func (h HashAlgorithm) Sum(buf []byte) []byte {
+	switch h {
+	case HashXXH3128:
+		sum := xxh3.Hash128(buf).Bytes()
+		return sum[:]
+	case HashSHA256:
+		sum := sha256.Sum256(buf)
+		return sum[:]
+	case HashBLAKE3:
+		sum := blake3.Sum256(buf)
+		return sum[:]
+	}
+	// xxhash64 digests are sent big endian.
+	v := xxhash.Checksum64(buf)
+	return []byte{byte(v >> 56), byte(v >> 48), byte(v >> 40), byte(v >> 32), byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
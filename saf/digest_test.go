@@ -0,0 +1,22 @@
+package saf
+
+import "testing"
+
+func TestHashAlgorithm(t *testing.T) {
+	sizes := map[HashAlgorithm]int{HashXXH64: 8, HashXXH3128: 16, HashSHA256: 32, HashBLAKE3: 32}
+
+	for h, size := range sizes {
+		t.Run(h.String(), func(t *testing.T) {
+			parsed, err := ParseHashAlgorithm(h.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := parsed, h; got != want {
+				t.Errorf("GOT: %v; WANT: %v", got, want)
+			}
+			if got, want := len(h.Sum([]byte("contents"))), size; got != want {
+				t.Errorf("GOT: %v; WANT: %v", got, want)
+			}
+		})
+	}
+}
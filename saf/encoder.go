@@ -0,0 +1,463 @@
+package saf
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// EncoderOptions configures an Encoder. The zero value writes a stream whose
+// file contents are neither compressed nor encrypted, verified with xxhash64,
+// without a signature or an index.
+type EncoderOptions struct {
+	Codec  Codec         // compression of file contents
+	Hash   HashAlgorithm // digest of file contents
+	Secret *Secret       // encrypts the stream when not nil
+
+	// SignKey signs the trailer when not nil. The signature is sent in the
+	// stream, unless DetachSignature is true, in which case it is returned by
+	// Signature after the Encoder is closed.
+	SignKey         ed25519.PrivateKey
+	DetachSignature bool
+
+	// Index appends an index of the entries, so they may be read at random
+	// from an archive file. It is ignored when encrypting, because encrypted
+	// archives cannot be read at random.
+	Index bool
+
+	// Rewriter renames entries as they are sent when not nil.
+	Rewriter *Rewriter
+
+	// KnownHashes holds the hashes of the contents the receiver already has
+	// when not nil. Regular files with these hashes are sent as references
+	// rather than contents. Its algorithm must be Hash.
+	KnownHashes *KnownHashes
+
+	// The remaining options only apply to entries added by AddPath.
+	Filter        *Filter     // leaves matching entries out of the stream
+	OneFileSystem bool        // skips contents of directories on other file systems
+	SkipFstypes   []string    // skips contents of directories on these file system types
+	Dereference   Dereference // which symlinks are sent as their referent
+	Sorted        bool        // sends the entries of each directory sorted by name
+
+	// Progress is invoked after each entry is sent when not nil, and Events
+	// is invoked with what happened to each entry when not nil.
+	Progress func(Progress)
+	Events   func(Event)
+
+	Logger Logger
+}
+
+// Encoder writes a stream of entries. Entries are added either from the file
+// system by AddPath, or one at a time by AddEntry, and Close must be invoked
+// to end the stream with its trailer. An Encoder is not safe for concurrent
+// use.
+type Encoder struct {
+	opts     EncoderOptions
+	log      Logger
+	header   Header
+	composer *gobsp.Composer
+	ew       *encryptWriter
+	rw       *rewriter
+	err      error // once a message cannot be sent, the stream cannot be completed
+	closed   bool
+
+	progress   Progress
+	entryStart time.Time // when reading the next entry to send began
+	stats      Stats
+	measuring  bool // counts entries for MeasurePaths without sending them
+
+	// State of a Copier, which visits entries rather than sending them.
+	visitor   Visitor
+	contents  io.Reader // contents of the regular file being visited
+	visitDirs []*Entry  // directories from the first path to the next entry
+
+	totals    *streamTotals
+	offset    int64 // offset of the next message from the start of the stream
+	indexing  bool
+	index     Index
+	indexDirs []string // names of directories from the stream root to the next entry
+	signature []byte
+
+	// dirs holds the directories from the stream root to the next entry
+	// added by AddEntry.
+	dirs []*Entry
+
+	// State of the file system walk of AddPath.
+	filterRoot   string
+	targetRoot   string
+	ignoreDirs   []ignoreDir
+	deviceStack  []uint64
+	encodingDirs map[fileID]struct{}
+
+	dirReadScratch  []byte
+	fileScratch     *bytes.Buffer
+	messageScratch  *bytes.Buffer
+	compressScratch *bytes.Buffer
+}
+
+// NewEncoder writes the stream header to w, and returns an Encoder that
+// writes the entries added to it to w. When encrypting, everything written to
+// w after the encryption header is sealed.
+func NewEncoder(w io.Writer, opts EncoderOptions) (*Encoder, error) {
+	if opts.KnownHashes != nil && opts.KnownHashes.Hash != opts.Hash {
+		return nil, errors.Errorf("cannot use known hashes: %s rather than %s", opts.KnownHashes.Hash, opts.Hash)
+	}
+	e := newEncoder(opts)
+
+	if opts.Secret != nil {
+		ew, err := newEncryptWriter(w, opts.Secret)
+		if err != nil {
+			return nil, err
+		}
+		e.ew, w = ew, ew
+	}
+	e.composer = gobsp.NewComposer(w)
+
+	if err := e.header.MarshalBinaryTo(e.messageScratch); err != nil {
+		return nil, errors.Wrap(err, "cannot encode header")
+	}
+	if err := e.compose(MessageSyn, e.messageScratch.Bytes()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// newEncoder returns an Encoder that has not yet been given a stream to
+// write.
+func newEncoder(opts EncoderOptions) *Encoder {
+	log := loggerOrNop(opts.Logger)
+	return &Encoder{
+		opts:            opts,
+		log:             log,
+		header:          Header{Codec: opts.Codec, Hash: opts.Hash},
+		rw:              opts.Rewriter.start(log),
+		totals:          newStreamTotals(),
+		indexing:        opts.Index && opts.Secret == nil,
+		encodingDirs:    make(map[fileID]struct{}),
+		dirReadScratch:  make([]byte, 64*1024),
+		fileScratch:     new(bytes.Buffer),
+		messageScratch:  new(bytes.Buffer),
+		compressScratch: new(bytes.Buffer),
+	}
+}
+
+// Header returns the header sent at the start of the stream.
+func (e *Encoder) Header() Header { return e.header }
+
+// AddEntry sends entry, whose slash separated path is relative to the root of
+// the stream. Directories in the path that were not already sent are sent
+// with mode 0755, and the owner and modification time of the entry. Because
+// entries are sent relative to their directory, adding the entries of each
+// directory together keeps the stream small. The contents of a regular file
+// are read from contents, which must provide entry.Size bytes, and its hash
+// is calculated by the Encoder. When AddEntry returns an error, the entry was
+// not sent, but other entries may still be added, unless the error came from
+// writing the stream.
+func (e *Encoder) AddEntry(entry *Entry, contents io.Reader) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.entryStart = time.Now()
+
+	name := strings.TrimPrefix(path.Clean("/"+entry.Path), "/")
+	if name == "" {
+		return errors.New("cannot add entry: empty path")
+	}
+	if entry.Size < 0 {
+		return errors.Errorf("cannot add entry: %s: invalid size: %d", name, entry.Size)
+	}
+	components := strings.Split(name, "/")
+	parents := components[:len(components)-1]
+
+	// Ascend to the deepest directory in common with the entry, then descend
+	// into the rest of its directories.
+	var common int
+	for common < len(e.dirs) && common < len(parents) && e.dirs[common].Name() == parents[common] {
+		common++
+	}
+	for len(e.dirs) > common {
+		if err := e.ascendEntry(); err != nil {
+			return err
+		}
+	}
+	for _, parent := range parents[common:] {
+		dir := &Entry{
+			Path:    path.Join(append(e.dirNames(), parent)...),
+			Mode:    fs.ModeDir | 0755,
+			ModTime: entry.ModTime,
+			UID:     entry.UID,
+			GID:     entry.GID,
+		}
+		if err := e.descendEntry(dir); err != nil {
+			return err
+		}
+	}
+
+	sent := *entry
+	sent.Path = name
+	switch {
+	case sent.Mode.IsDir():
+		return e.descendEntry(&sent)
+	case sent.Mode.IsRegular():
+		if err := e.readContents(contents, sent.Size); err != nil {
+			return errors.Wrapf(err, "cannot add entry: %s", name)
+		}
+	case sent.Mode&fs.ModeDevice != 0:
+		return errors.Errorf("cannot add entry: %s: devices are not supported", name)
+	}
+	return e.sendEntry(&sent, name)
+}
+
+func (e *Encoder) dirNames() []string {
+	names := make([]string, len(e.dirs))
+	for i, d := range e.dirs {
+		names[i] = d.Name()
+	}
+	return names
+}
+
+// descendEntry sends the directory entry, and makes it the directory of the
+// next entry added by AddEntry.
+func (e *Encoder) descendEntry(dir *Entry) error {
+	if err := e.sendEntry(dir, dir.Path); err != nil {
+		return err
+	}
+	e.dirs = append(e.dirs, dir)
+	return nil
+}
+
+// ascendEntry ascends out of the directory of the next entry added by
+// AddEntry.
+func (e *Encoder) ascendEntry() error {
+	d := e.dirs[len(e.dirs)-1]
+	e.dirs = e.dirs[:len(e.dirs)-1]
+	return e.sendAscend(d.ModTime)
+}
+
+// readContents reads size bytes of file contents into fileScratch. Memory is
+// only allocated for the contents as they are read, beyond a limit, because
+// the size is provided by the caller.
+func (e *Encoder) readContents(r io.Reader, size int64) error {
+	e.fileScratch.Reset()
+	if r == nil {
+		if size == 0 {
+			return nil
+		}
+		r = bytes.NewReader(nil)
+	}
+	e.fileScratch.Grow(preallocSize(size))
+	n, err := e.fileScratch.ReadFrom(io.LimitReader(r, size))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n < size {
+		return errors.Wrapf(io.ErrUnexpectedEOF, "read fewer than expected bytes: %d < %d", n, size)
+	}
+	return nil
+}
+
+// sendEntry sends the message for entry, which is displayed as targetFull.
+// The contents of a regular file must be in fileScratch.
+func (e *Encoder) sendEntry(entry *Entry, targetFull string) error {
+	messageType, err := entryMessageType(entry.Mode)
+	if err != nil {
+		return err
+	}
+	if e.measuring {
+		if e.rw != nil {
+			if _, ok := e.rw.entry(messageType, entry.Name()); !ok {
+				return nil // stripped entries are not sent
+			}
+		}
+		e.progress.add(entry)
+		return nil
+	}
+	if e.visitor != nil {
+		return e.visitEntry(entry, targetFull)
+	}
+
+	if messageType == MessageRegularFile {
+		entry.Size = int64(e.fileScratch.Len())
+		entry.Hash = e.header.Hash.Sum(e.fileScratch.Bytes())
+		e.log.Verbosef("%s %s:%x\n", targetFull, e.header.Hash, entry.Hash)
+	}
+
+	e.messageScratch.Reset()
+	if err = marshalEntry(e.messageScratch, messageType, entry); err != nil {
+		return err
+	}
+	if messageType == MessageRegularFile {
+		if err = e.appendContents(entry); err != nil {
+			return err
+		}
+	}
+	sent, err := e.composeRewritten(messageType, e.messageScratch.Bytes())
+	if err != nil || !sent {
+		return err // entries stripped by the rewriter are not counted
+	}
+	e.sent(entry, ActionEncoded)
+	return nil
+}
+
+// sent counts the entry, and reports its progress and what happened to it.
+func (e *Encoder) sent(entry *Entry, action Action) {
+	e.progress.add(entry)
+	e.stats.count(entry)
+	if e.opts.Progress != nil {
+		e.opts.Progress(e.progress)
+	}
+	e.event(Event{Path: entry.Path, Mode: entry.Mode, Action: action, Size: entry.Size, Duration: time.Since(e.entryStart)})
+}
+
+// appendContents appends the codec and contents of the regular file in
+// fileScratch to the message. Compressed contents are only sent when they are
+// smaller than the original, and contents the receiver already has are not
+// sent at all.
+func (e *Encoder) appendContents(entry *Entry) error {
+	var err error
+
+	if entry.Size > 0 && e.opts.KnownHashes.Has(entry.Hash) {
+		e.log.Debugf("%s codec: %s\n", entry.Path, codecReferenced)
+		return errors.Wrap(gobsp.Uint8(codecReferenced).MarshalBinaryTo(e.messageScratch), "cannot encode codec")
+	}
+
+	fileCodec := e.header.Codec.ForName(entry.Name())
+	if fileCodec != CodecNone {
+		e.compressScratch.Reset()
+		if err = fileCodec.Compress(e.compressScratch, e.fileScratch.Bytes()); err != nil {
+			return errors.Wrap(err, "cannot compress contents")
+		}
+		if int64(e.compressScratch.Len()) >= entry.Size {
+			fileCodec = CodecNone
+		}
+	}
+
+	e.log.Debugf("%s codec: %s\n", entry.Path, fileCodec)
+	if err = gobsp.Uint8(fileCodec).MarshalBinaryTo(e.messageScratch); err != nil {
+		return errors.Wrap(err, "cannot encode codec")
+	}
+
+	if fileCodec == CodecNone {
+		e.messageScratch.Grow(e.fileScratch.Len())
+		_, err = e.fileScratch.WriteTo(e.messageScratch)
+	} else {
+		e.messageScratch.Grow(e.compressScratch.Len())
+		_, err = e.compressScratch.WriteTo(e.messageScratch)
+	}
+	return errors.Wrap(err, "cannot encode contents")
+}
+
+// sendAscend sends the modification time of the directory being ascended out
+// of.
+func (e *Encoder) sendAscend(mtime time.Time) error {
+	if e.measuring {
+		if e.rw != nil {
+			_, err := e.rw.ascend()
+			return err
+		}
+		return nil
+	}
+	if e.visitor != nil {
+		return e.visitAscend()
+	}
+	e.messageScratch.Reset()
+	if err := gobsp.Int64(mtime.Unix()).MarshalBinaryTo(e.messageScratch); err != nil {
+		return errors.Wrap(err, "cannot encode modification time")
+	}
+	return e.compose(MessageDirectoryAscend, e.messageScratch.Bytes())
+}
+
+// indexMessage records an index entry for the message sent at offset. The
+// header, directory ascend, and other messages that are not entries are not
+// indexed.
+func (e *Encoder) indexMessage(offset int64, messageType gobsp.MessageType, message []byte) error {
+	if messageType == MessageDirectoryAscend {
+		if len(e.indexDirs) > 0 {
+			e.indexDirs = e.indexDirs[:len(e.indexDirs)-1]
+		}
+		return nil
+	}
+	if _, ok := entryModeTypes[messageType]; !ok {
+		return nil
+	}
+	entry, err := unmarshalEntry(bytes.NewReader(message), messageType)
+	if err != nil {
+		return errors.Wrap(err, "cannot index entry")
+	}
+	name := entry.Path
+	entry.Path = path.Join(append(e.indexDirs, name)...)
+	if messageType == MessageDirectoryDescend {
+		e.indexDirs = append(e.indexDirs, name)
+	}
+	e.index = append(e.index, IndexEntry{Entry: *entry, Offset: offset})
+	return nil
+}
+
+// Close ascends out of the directories of entries added by AddEntry, sends
+// the index when requested, and ends the stream with its trailer and
+// signature. It flushes the stream to the underlying io.Writer, but does not
+// close it.
+func (e *Encoder) Close() error {
+	if e.closed {
+		return errors.New("cannot close encoder: already closed")
+	}
+	e.closed = true
+
+	var err error
+	for err == nil && len(e.dirs) > 0 {
+		err = e.ascendEntry()
+	}
+
+	// The index precedes the trailer so it is included in the digest and
+	// signature, while the footer that locates it is always the final
+	// message.
+	var indexOffset int64
+	if err == nil && e.indexing {
+		indexOffset = e.offset
+		e.messageScratch.Reset()
+		if err = e.index.MarshalBinaryTo(e.messageScratch); err == nil {
+			err = e.compose(MessageIndex, e.messageScratch.Bytes())
+		}
+	}
+
+	// The trailer lets the recipient detect when the stream was truncated, and
+	// its signature proves where the stream came from.
+	var trailer []byte
+	if err == nil {
+		trailer, err = e.composeTrailer()
+	}
+	if err == nil && e.opts.SignKey != nil {
+		err = e.composeSignature(trailer)
+	}
+	if err == nil && e.indexing {
+		err = e.composer.Compose(MessageFooter, FooterPayload(indexOffset))
+	}
+
+	// Flush the composer's buffer, and seal the final encrypted chunk when
+	// encrypting.
+	if err2 := e.composer.Close(); err == nil {
+		err = err2
+	}
+	if e.ew != nil {
+		if err2 := e.ew.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Stats returns the counts of the entries sent so far, and of those that
+// were skipped or could not be sent.
+func (e *Encoder) Stats() Stats { return e.stats }
+
+// Signature returns the detached signature of the stream after the Encoder
+// is closed, or nil when the signature was sent in the stream.
+func (e *Encoder) Signature() []byte { return e.signature }
@@ -0,0 +1,155 @@
+package saf
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// Entry describes a file system entry in a stream. The type of the entry is
+// in the type bits of its mode.
+type Entry struct {
+	Path     string      // slash separated path from the root of the stream
+	Mode     fs.FileMode // permission and type bits
+	ModTime  time.Time   // modification time, in whole seconds
+	UID, GID uint32      // numeric owner
+	Size     int64       // size of regular file contents
+	Hash     []byte      // digest of regular file contents
+	Linkname string      // referent of symlink
+}
+
+// Name returns the final component of the entry path.
+func (e *Entry) Name() string { return path.Base(e.Path) }
+
+// entryMessageType returns the type of message that sends an entry with the
+// specified mode.
+func entryMessageType(mode fs.FileMode) (gobsp.MessageType, error) {
+	switch {
+	case mode.IsRegular():
+		return MessageRegularFile, nil
+	case mode.IsDir():
+		return MessageDirectoryDescend, nil
+	case mode&fs.ModeSymlink != 0:
+		return MessageSymlink, nil
+	case mode&fs.ModeNamedPipe != 0:
+		return MessageFIFO, nil
+	case mode&fs.ModeSocket != 0:
+		return MessageSocket, nil
+	case mode&fs.ModeDevice != 0:
+		return MessageDevice, nil
+	}
+	return 0, errors.Errorf("file mode type not supported: %s", mode.Type())
+}
+
+// entryModeTypes maps each entry message type to the type bits of its mode.
+var entryModeTypes = map[gobsp.MessageType]fs.FileMode{
+	MessageRegularFile:      0,
+	MessageDirectoryDescend: fs.ModeDir,
+	MessageSymlink:          fs.ModeSymlink,
+	MessageFIFO:             fs.ModeNamedPipe,
+	MessageSocket:           fs.ModeSocket,
+	MessageDevice:           fs.ModeDevice,
+}
+
+// marshaler and unmarshaler are implemented by each gobsp primitive.
+type marshaler interface {
+	MarshalBinaryTo(io.Writer) error
+}
+
+type unmarshaler interface {
+	UnmarshalBinaryFrom(io.Reader) error
+}
+
+// namedField is a field of a message, named for error messages.
+type namedField struct {
+	what  string
+	field unmarshaler
+}
+
+// marshalEntry writes the payload of the message that sends entry, named by
+// its final path component, up to but not including the codec and contents
+// of a regular file.
+func marshalEntry(w io.Writer, messageType gobsp.MessageType, e *Entry) error {
+	name := gobsp.String(e.Name())
+	mtime := gobsp.Int64(e.ModTime.Unix())
+	mode := gobsp.Uint32(e.Mode)
+	uid, gid := gobsp.Uint32(e.UID), gobsp.Uint32(e.GID)
+
+	var fields []marshaler
+	switch messageType {
+	case MessageRegularFile:
+		fields = []marshaler{name, mtime, mode, uid, gid, gobsp.String(e.Hash), gobsp.UVWI(e.Size)}
+	case MessageDirectoryDescend:
+		fields = []marshaler{name, mode, mtime, uid, gid}
+	case MessageSymlink:
+		fields = []marshaler{name, gobsp.String(e.Linkname), mtime, mode, uid, gid}
+	case MessageFIFO, MessageSocket:
+		fields = []marshaler{name, mtime, mode, uid, gid}
+	case MessageDevice:
+		// Devices are not yet supported, and only send their name.
+		fields = []marshaler{name}
+	default:
+		return errors.Errorf("cannot encode entry: message type %d", messageType)
+	}
+	for _, field := range fields {
+		if err := field.MarshalBinaryTo(w); err != nil {
+			return errors.Wrapf(err, "cannot encode entry: %s", e.Path)
+		}
+	}
+	return nil
+}
+
+// unmarshalEntry reads the payload of an entry message up to but not
+// including the codec and contents of a regular file. The path of the
+// returned entry is its name.
+func unmarshalEntry(r io.Reader, messageType gobsp.MessageType) (*Entry, error) {
+	var nameField, hash, linkname gobsp.String
+	var mtimeField gobsp.Int64
+	var modeField, uid, gid gobsp.Uint32
+	var size gobsp.UVWI
+
+	name, mtime, mode := namedField{"name", &nameField}, namedField{"modification time", &mtimeField}, namedField{"mode", &modeField}
+	owner := []namedField{{"user ID", &uid}, {"group ID", &gid}}
+
+	var fields []namedField
+	switch messageType {
+	case MessageRegularFile:
+		fields = append([]namedField{name, mtime, mode}, owner...)
+		fields = append(fields, namedField{"hash", &hash}, namedField{"size", &size})
+	case MessageDirectoryDescend:
+		fields = append([]namedField{name, mode, mtime}, owner...)
+	case MessageSymlink:
+		fields = append([]namedField{name, {"referent", &linkname}, mtime, mode}, owner...)
+	case MessageFIFO, MessageSocket:
+		fields = append([]namedField{name, mtime, mode}, owner...)
+	case MessageDevice:
+		fields = []namedField{name}
+	default:
+		return nil, errors.Errorf("cannot decode entry: message type %d", messageType)
+	}
+	for _, f := range fields {
+		if err := f.field.UnmarshalBinaryFrom(r); err != nil {
+			return nil, errors.Wrapf(err, "cannot decode %s", f.what)
+		}
+	}
+
+	e := &Entry{
+		Path:     string(nameField),
+		Mode:     fs.FileMode(modeField) | entryModeTypes[messageType],
+		UID:      uint32(uid),
+		GID:      uint32(gid),
+		Size:     int64(size),
+		Linkname: string(linkname),
+	}
+	if messageType != MessageDevice {
+		e.ModTime = time.Unix(int64(mtimeField), 0)
+	}
+	if messageType == MessageRegularFile {
+		e.Hash = []byte(hash)
+	}
+	return e, nil
+}
@@ -0,0 +1,71 @@
+package saf
+
+import (
+	"io/fs"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrHashMismatch is the cause of the error returned when the contents of a
+// regular file read from a stream do not match its hash.
+var ErrHashMismatch = errors.New("contents do not match hash")
+
+// Action is what happened to an entry.
+type Action string
+
+const (
+	ActionEncoded Action = "encoded" // sent by an Encoder
+	ActionDecoded Action = "decoded" // visited by a Decoder without error
+	ActionCopied  Action = "copied"  // visited by a Copier without error
+	ActionSkipped Action = "skipped" // excluded by a filter, or not selected
+	ActionFailed  Action = "failed"  // could not be sent or visited
+)
+
+// Event describes what happened to a single entry. Entries that failed
+// before their type was known have a Mode of fs.ModeIrregular, and entries
+// that could not be decoded have an empty Path.
+type Event struct {
+	Path     string
+	Mode     fs.FileMode
+	Action   Action
+	Size     int64         // size of the contents of a regular file
+	Duration time.Duration // time taken to read and send, or to visit
+	Err      error         // why the entry failed
+}
+
+func (e *Encoder) event(ev Event) {
+	if e.opts.Events != nil {
+		e.opts.Events(ev)
+	}
+}
+
+// skipped records that the entry was excluded by a filter.
+func (e *Encoder) skipped(pathname string, mode fs.FileMode) {
+	e.stats.Skipped++
+	e.event(Event{Path: pathname, Mode: mode, Action: ActionSkipped})
+}
+
+// failed records that the entry could not be sent.
+func (e *Encoder) failed(pathname string, mode fs.FileMode, duration time.Duration, err error) {
+	e.stats.Failed++
+	e.event(Event{Path: pathname, Mode: mode, Action: ActionFailed, Duration: duration, Err: err})
+}
+
+func (d *Decoder) event(ev Event) {
+	if d.opts.Events != nil {
+		d.opts.Events(ev)
+	}
+}
+
+// skipped records that the entry was not selected.
+func (d *Decoder) skipped(pathname string, mode fs.FileMode, size int64) {
+	d.stats.Skipped++
+	d.event(Event{Path: pathname, Mode: mode, Action: ActionSkipped, Size: size})
+}
+
+// failed records that the entry could not be decoded or visited.
+func (d *Decoder) failed(entry *Entry, duration time.Duration, err error) {
+	d.stats.Failed++
+	d.event(Event{Path: entry.Path, Mode: entry.Mode, Action: ActionFailed, Size: entry.Size, Duration: duration, Err: err})
+}
@@ -0,0 +1,44 @@
+package saf
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	var events []string
+	record := func(ev Event) {
+		events = append(events, string(ev.Action)+" "+ev.Path)
+	}
+
+	stream := encodeEntries(t, EncoderOptions{Events: record}, "a/p|", "a/b/q", "c/r")
+	if got, want := strings.Join(events, ","), "encoded a,encoded a/p,encoded a/b,encoded a/b/q,encoded c,encoded c/r"; got != want {
+		t.Errorf("GOT: %s; WANT: %s", got, want)
+	}
+
+	events = nil
+	selected := func(pathname string) bool { return strings.HasPrefix(pathname, "a/b") }
+	if _, err := decodeEntries(t, bytes.NewBuffer(stream), DecoderOptions{Select: selected, Events: record}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(events, ","), "skipped a/p,decoded a,decoded a/b,decoded a/b/q,skipped c/r"; got != want {
+		t.Errorf("GOT: %s; WANT: %s", got, want)
+	}
+
+	t.Run("hash mismatch", func(t *testing.T) {
+		damaged := append([]byte(nil), stream...)
+		damaged[bytes.Index(damaged, []byte("a/b/q"))] ^= 0xff
+
+		var failed []Event
+		_, _ = decodeEntries(t, bytes.NewBuffer(damaged), DecoderOptions{Events: func(ev Event) {
+			if ev.Action == ActionFailed {
+				failed = append(failed, ev)
+			}
+		}})
+		if len(failed) != 1 || failed[0].Path != "a/b/q" || !errors.Is(failed[0].Err, ErrHashMismatch) {
+			t.Errorf("GOT: %+v; WANT: a/b/q failed with ErrHashMismatch", failed)
+		}
+	})
+}
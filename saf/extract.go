@@ -0,0 +1,249 @@
+package saf
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExtractorOptions configures an Extractor.
+type ExtractorOptions struct {
+	// Deferred stages the contents of regular files, and defers every other
+	// change to the Sink until Finish is invoked, so nothing is committed
+	// unless the stream is verified. Directories are still created as they
+	// are visited, because staged contents are kept in them, so a stream
+	// that is not verified may still create directories in the Sink.
+	Deferred bool
+
+	// Events, when not nil, is invoked with each deferred change that fails
+	// when Finish commits it.
+	Events func(Event)
+
+	Logger Logger
+}
+
+// Extractor is a Visitor that creates each entry it visits in a Sink.
+type Extractor struct {
+	sink Sink
+	opts ExtractorOptions
+	log  Logger
+	hash HashAlgorithm // of the stream, for a Sink that is a ContentLinker
+
+	// pending holds the changes waiting for Finish, and discards holds the
+	// functions that remove the staged contents of regular files.
+	pending  []pendingChange
+	discards []func() error
+}
+
+// pendingChange is a change to an entry deferred until Finish.
+type pendingChange struct {
+	entry *Entry
+	fn    func() error
+}
+
+// NewExtractor returns an Extractor that creates entries in sink, such as a
+// DirSink to create them in the local file system.
+func NewExtractor(sink Sink, opts ExtractorOptions) *Extractor {
+	return &Extractor{sink: sink, opts: opts, log: loggerOrNop(opts.Logger)}
+}
+
+// VisitHeader records the hash algorithm of the stream.
+func (x *Extractor) VisitHeader(h Header) error {
+	x.hash = h.Hash
+	return nil
+}
+
+// Visit creates the entry.
+func (x *Extractor) Visit(entry *Entry, contents io.Reader) error {
+	pathname := entry.Path
+
+	switch mode := entry.Mode; {
+	case mode.IsDir():
+		return x.sink.Mkdir(pathname, mode)
+	case mode.IsRegular():
+		return x.createFile(entry, contents)
+	case mode&fs.ModeSymlink != 0:
+		return x.commit(entry, func() error {
+			return x.sink.Symlink(entry.Linkname, pathname)
+		})
+	case mode&fs.ModeNamedPipe != 0:
+		return x.commit(entry, func() error {
+			if err := x.sink.Mkfifo(pathname, mode); err != nil {
+				return err
+			}
+			return x.sink.SetMetadata(pathname, mode, entry.ModTime)
+		})
+	case mode&fs.ModeSocket != 0:
+		sm, ok := x.sink.(interface {
+			mksocket(string, fs.FileMode, time.Time) error
+		})
+		if !ok {
+			return errors.Errorf("%s cannot decode socket: not supported by sink", pathname)
+		}
+		return x.commit(entry, func() error {
+			return errors.Wrap(sm.mksocket(pathname, mode, entry.ModTime), "cannot decode socket")
+		})
+	}
+	return errors.Errorf("%s decode device not implemented", pathname)
+}
+
+// Ascend sets the modification time of the directory, which must follow any
+// deferred changes to its contents.
+func (x *Extractor) Ascend(dir *Entry) error {
+	return x.commit(dir, func() error {
+		return x.sink.Ascend(dir.Path, dir.ModTime)
+	})
+}
+
+// createFile creates the regular file with its verified contents, either
+// immediately, or when changes are deferred, by staging its contents until
+// the stream is verified.
+func (x *Extractor) createFile(entry *Entry, contents io.Reader) error {
+	pathname := entry.Path
+
+	// Verify contents before changing the sink. Contents that were not sent
+	// must already be in the sink.
+	if fc, ok := contents.(*fileContents); ok {
+		if err := fc.load(); err != nil {
+			if !errors.Is(err, ErrContentsNotSent) {
+				return err
+			}
+			return x.commit(entry, func() error { return x.createReferenced(entry, err) })
+		}
+	}
+
+	setMetadata := func() error {
+		return x.sink.SetMetadata(pathname, entry.Mode, entry.ModTime)
+	}
+
+	if !x.opts.Deferred {
+		linked, err := x.linkFile(entry)
+		if err == nil && !linked {
+			err = x.sink.CreateFile(pathname, contents)
+		}
+		if err != nil {
+			return err
+		}
+		return setMetadata()
+	}
+
+	stage := x.stageFile
+	if stager, ok := x.sink.(FileStager); ok {
+		stage = stager.StageFile
+	}
+	commit, discard, err := stage(pathname, contents)
+	if err != nil {
+		return err
+	}
+	x.discards = append(x.discards, discard)
+	return x.commit(entry, func() error {
+		linked, err := x.linkFile(entry)
+		if err == nil && !linked {
+			err = commit()
+		}
+		if err != nil {
+			return err
+		}
+		return setMetadata()
+	})
+}
+
+// createReferenced creates the regular file whose contents were not sent
+// from the contents the sink already has, or returns an error with cause when
+// the sink does not have them.
+func (x *Extractor) createReferenced(entry *Entry, cause error) error {
+	linked, err := x.linkFile(entry)
+	if err == nil && !linked {
+		err = errors.Wrap(cause, "cannot find contents in destination")
+	}
+	if err != nil {
+		return err
+	}
+	return x.sink.SetMetadata(entry.Path, entry.Mode, entry.ModTime)
+}
+
+// linkFile creates the regular file from contents the sink already has when
+// it is a ContentLinker, and returns false when it did not.
+func (x *Extractor) linkFile(entry *Entry) (bool, error) {
+	if linker, ok := x.sink.(ContentLinker); ok {
+		return linker.LinkFile(entry, x.hash)
+	}
+	return false, nil
+}
+
+// stageFile returns a function that invokes CreateFile with the contents
+// after writing them to a temporary file, for a Sink that cannot stage the
+// contents of regular files itself.
+func (x *Extractor) stageFile(pathname string, contents io.Reader) (func() error, func() error, error) {
+	fh, err := ioutil.TempFile("", "tsync-staged-")
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	staged := fh.Name()
+	discard := func() error {
+		if err := os.Remove(staged); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	_, err = io.Copy(fh, contents)
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = discard() // ignore secondary error
+		return nil, nil, errors.WithStack(err)
+	}
+	commit := func() error {
+		fh, err := os.Open(staged)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = x.sink.CreateFile(pathname, fh)
+		if err2 := fh.Close(); err == nil {
+			err = err2
+		}
+		return err
+	}
+	return commit, discard, nil
+}
+
+// commit invokes fn to change the entry, unless changes are deferred, in
+// which case fn is invoked by Finish after the stream is verified.
+func (x *Extractor) commit(entry *Entry, fn func() error) error {
+	if !x.opts.Deferred {
+		return fn()
+	}
+	x.pending = append(x.pending, pendingChange{entry: entry, fn: fn})
+	return nil
+}
+
+// Finish applies every deferred change when verified is true, otherwise it
+// discards them. In both cases it removes the staged contents of regular
+// files that were not committed. Each change that fails is reported as a
+// failed Event. It does nothing unless changes are deferred.
+func (x *Extractor) Finish(verified bool) {
+	if verified {
+		for _, pc := range x.pending {
+			if err := pc.fn(); err != nil {
+				x.log.Warningf("%s\n", err)
+				if x.opts.Events != nil {
+					x.opts.Events(Event{Path: pc.entry.Path, Mode: pc.entry.Mode, Action: ActionFailed, Err: err})
+				}
+			}
+		}
+	} else if len(x.pending) > 0 {
+		x.log.Warningf("stream not verified: discarding %d entries\n", len(x.pending))
+	}
+	for _, discard := range x.discards {
+		if err := discard(); err != nil {
+			x.log.Warningf("%s\n", err)
+		}
+	}
+	x.pending = nil
+	x.discards = nil
+}
@@ -0,0 +1,225 @@
+package saf
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// extractEntries decodes the stream into sink, and finishes the extraction as
+// though the stream was verified when verified is true.
+func extractEntries(t *testing.T, stream []byte, sink Sink, deferred, verified bool) {
+	t.Helper()
+	d, err := NewDecoder(bytes.NewReader(stream), DecoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewExtractor(sink, ExtractorOptions{Deferred: deferred})
+	if err = d.Decode(x); err != nil {
+		t.Fatal(err)
+	}
+	x.Finish(verified)
+}
+
+func sinkNames(ms *MemorySink) string {
+	var names []string
+	for name := range ms.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestExtractor(t *testing.T) {
+	stream := encodeEntries(t, EncoderOptions{}, "a/b/c", "a/p|", "d")
+	mtime := time.Unix(1600000000, 0)
+
+	t.Run("memory", func(t *testing.T) {
+		ms := NewMemorySink()
+		extractEntries(t, stream, ms, false, true)
+
+		if got, want := sinkNames(ms), "a,a/b,a/b/c,a/p,d"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		c := ms.Entries["a/b/c"]
+		if got, want := string(c.Contents), "a/b/c"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+		if got, want := c.Mode, fs.FileMode(0644); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := ms.Entries["a/p"].Mode, fs.ModeNamedPipe|0644; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := ms.Entries["a"].ModTime, mtime; !got.Equal(want) {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("memory deferred", func(t *testing.T) {
+		ms := NewMemorySink()
+		extractEntries(t, stream, ms, true, true)
+
+		if got, want := sinkNames(ms), "a,a/b,a/b/c,a/p,d"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := string(ms.Entries["d"].Contents), "d"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	t.Run("memory not verified", func(t *testing.T) {
+		ms := NewMemorySink()
+		extractEntries(t, stream, ms, true, false)
+
+		if got, want := sinkNames(ms), "a,a/b"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		root := t.TempDir()
+		extractEntries(t, stream, DirSink(root), false, true)
+
+		for _, name := range []string{"a/b/c", "d"} {
+			buf, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(buf), name; got != want {
+				t.Errorf("GOT: %q; WANT: %q", got, want)
+			}
+		}
+	})
+
+	t.Run("directory not verified", func(t *testing.T) {
+		root := t.TempDir()
+		extractEntries(t, stream, DirSink(root), true, false)
+
+		names, err := ioutil.ReadDir(filepath.Join(root, "a", "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(names), 0; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("socket not verified", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		e, err := NewEncoder(buf, EncoderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.AddEntry(&Entry{Path: "s", Mode: fs.ModeSocket | 0755, ModTime: mtime}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		root := t.TempDir()
+		if err = ioutil.WriteFile(filepath.Join(root, "s"), []byte("s"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		extractEntries(t, buf.Bytes(), DirSink(root), true, false)
+
+		if got, err := ioutil.ReadFile(filepath.Join(root, "s")); err != nil || string(got) != "s" {
+			t.Errorf("GOT: %q, %v; WANT: %q", got, err, "s")
+		}
+	})
+
+	t.Run("deferred failure", func(t *testing.T) {
+		d, err := NewDecoder(bytes.NewReader(stream), DecoderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var failed []string
+		x := NewExtractor(failingFIFOSink{NewMemorySink()}, ExtractorOptions{
+			Deferred: true,
+			Events: func(ev Event) {
+				if ev.Action == ActionFailed && errors.Is(ev.Err, errNoFIFO) {
+					failed = append(failed, ev.Path)
+				}
+			},
+		})
+		if err = d.Decode(x); err != nil {
+			t.Fatal(err)
+		}
+		x.Finish(true)
+		if got, want := strings.Join(failed, ","), "a/p"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+}
+
+var errNoFIFO = errors.New("cannot create FIFO")
+
+// failingFIFOSink is a MemorySink that cannot create FIFOs.
+type failingFIFOSink struct {
+	*MemorySink
+}
+
+func (failingFIFOSink) Mkfifo(string, fs.FileMode) error { return errNoFIFO }
+
+func TestDirSinkCreateFile(t *testing.T) {
+	root := t.TempDir()
+	pathname := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(pathname, []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Keep the file open, so its inode is not reused when it is removed.
+	fh, err := os.Open(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	before, err := fh.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("written over", func(t *testing.T) {
+		if err := DirSink(root).CreateFile("file", strings.NewReader("new")); err != nil {
+			t.Fatal(err)
+		}
+		after, err := os.Stat(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(before, after) {
+			t.Errorf("GOT: replaced; WANT: written over")
+		}
+		if got, err := ioutil.ReadFile(pathname); err != nil || string(got) != "new" {
+			t.Errorf("GOT: %q, %v; WANT: %q", got, err, "new")
+		}
+	})
+
+	t.Run("hard linked", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("link counts not supported")
+		}
+		other := filepath.Join(root, "other")
+		if err := os.Link(pathname, other); err != nil {
+			t.Skip(err)
+		}
+		if err := DirSink(root).CreateFile("file", strings.NewReader("newer")); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(pathname); err != nil || string(got) != "newer" {
+			t.Errorf("GOT: %q, %v; WANT: %q", got, err, "newer")
+		}
+		if got, err := ioutil.ReadFile(other); err != nil || string(got) != "new" {
+			t.Errorf("GOT: %q, %v; WANT: %q", got, err, "new")
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package saf
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ignoreFileName is the name of the file in any directory being encoded that
+// lists patterns of entries in that directory and below it to leave out of
+// the stream, using the same syntax as gitignore files.
+const ignoreFileName = ".tsyncignore"
+
+// filterRule either includes or excludes entries matching pattern.
+type filterRule struct {
+	pattern string
+	include bool
+	dirOnly bool // pattern only matches directories
+}
+
+func (r filterRule) match(pathname string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return matchPattern(r.pattern, pathname)
+}
+
+func newFilterRule(pattern string, include bool) (filterRule, bool) {
+	r := filterRule{include: include}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	r.pattern = pattern
+	return r, pattern != ""
+}
+
+// Filter holds include and exclude rules, in the order they are tested. Like
+// rsync, the first matching rule decides whether an entry is included, and
+// entries matching no rule are included.
+type Filter struct {
+	rules []filterRule
+}
+
+// NewFilter returns a filter that tests the include patterns before the
+// exclude patterns. Patterns are glob patterns matched against the path of
+// each entry relative to the root of the stream. A pattern without a slash
+// matches the final component of the path, a pattern ending with a slash only
+// matches directories, and "**" matches any number of directories. Use the
+// Include and Exclude methods of a new Filter to test rules in another order.
+func NewFilter(include, exclude []string) *Filter {
+	f := new(Filter)
+	f.Include(include...)
+	f.Exclude(exclude...)
+	return f
+}
+
+// Include appends rules that include entries matching the patterns.
+func (f *Filter) Include(patterns ...string) {
+	f.appendPatterns(patterns, true)
+}
+
+// Exclude appends rules that exclude entries matching the patterns.
+func (f *Filter) Exclude(patterns ...string) {
+	f.appendPatterns(patterns, false)
+}
+
+func (f *Filter) appendPatterns(patterns []string, include bool) {
+	for _, pattern := range patterns {
+		if r, ok := newFilterRule(pattern, include); ok {
+			f.rules = append(f.rules, r)
+		}
+	}
+}
+
+// ReadExcludeFrom appends the rules read from the file, in the order they
+// appear. Like rsync, lines beginning with "+ " are include rules, and other
+// lines, optionally beginning with "- ", are exclude rules.
+func (f *Filter) ReadExcludeFrom(pathname string) error {
+	rules, err := readFilterFile(pathname, parseExcludeFromLine)
+	if err != nil {
+		return err
+	}
+	f.rules = append(f.rules, rules...)
+	return nil
+}
+
+// ignoreDir holds the rules read from the ignore file of a directory being
+// encoded, where base is the path of that directory relative to the root of
+// the stream.
+type ignoreDir struct {
+	base  string
+	rules []filterRule
+}
+
+// readFilterFile returns the rules parsed from each line of the file.
+func readFilterFile(pathname string, parse func(string) (filterRule, bool)) ([]filterRule, error) {
+	fh, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	var rules []filterRule
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		if r, ok := parse(scanner.Text()); ok {
+			rules = append(rules, r)
+		}
+	}
+	err = scanner.Err()
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %q", pathname)
+	}
+	return rules, nil
+}
+
+// parseExcludeFromLine parses a line of an --exclude-from file. Like rsync,
+// lines beginning with "+ " are include rules, and other lines, optionally
+// beginning with "- ", are exclude rules. Blank lines and lines beginning with
+// "#" or ";" are ignored.
+func parseExcludeFromLine(line string) (filterRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == ';' {
+		return filterRule{}, false
+	}
+	switch {
+	case strings.HasPrefix(line, "+ "):
+		return newFilterRule(strings.TrimSpace(line[2:]), true)
+	case strings.HasPrefix(line, "- "):
+		return newFilterRule(strings.TrimSpace(line[2:]), false)
+	}
+	return newFilterRule(line, false)
+}
+
+// parseIgnoreLine parses a line of an ignore file. Like gitignore, lines
+// beginning with "!" re-include entries excluded by earlier lines, blank
+// lines and lines beginning with "#" are ignored, and a leading backslash
+// escapes either character.
+func parseIgnoreLine(line string) (filterRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || line[0] == '#' {
+		return filterRule{}, false
+	}
+	include := line[0] == '!'
+	if include {
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+	return newFilterRule(line, include)
+}
+
+// pushIgnoreFile reads the ignore file in the directory at targetFull, when
+// it exists, and returns true when its rules were pushed on ignoreDirs.
+func (e *Encoder) pushIgnoreFile(targetFull string) (bool, error) {
+	rules, err := readFilterFile(filepath.Join(targetFull, ignoreFileName), parseIgnoreLine)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return false, nil
+		}
+		return false, err
+	}
+	if len(rules) == 0 {
+		return false, nil
+	}
+	e.ignoreDirs = append(e.ignoreDirs, ignoreDir{base: e.filterPath(targetFull), rules: rules})
+	return true, nil
+}
+
+func (e *Encoder) popIgnoreFile() {
+	e.ignoreDirs = e.ignoreDirs[:len(e.ignoreDirs)-1]
+}
+
+// filterPath returns the path of targetFull relative to the root of the
+// stream, using slashes.
+func (e *Encoder) filterPath(targetFull string) string {
+	rel, err := filepath.Rel(e.filterRoot, targetFull)
+	if err != nil {
+		return filepath.ToSlash(targetFull)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// excluded returns true when the entry at pathname, relative to the root of
+// the stream, should be left out of the stream. Rules from the filter are
+// tested first, and the first match decides. Otherwise, like gitignore, the
+// last matching rule from the ignore files decides, where rules in deeper
+// directories override those in their ancestors.
+func (e *Encoder) excluded(pathname string, isDir bool) bool {
+	if e.opts.Filter != nil {
+		for _, r := range e.opts.Filter.rules {
+			if r.match(pathname, isDir) {
+				return !r.include
+			}
+		}
+	}
+
+	var exclude bool
+	for _, d := range e.ignoreDirs {
+		if !strings.HasPrefix(pathname, d.base+"/") {
+			continue
+		}
+		rel := pathname[len(d.base)+1:]
+		for _, r := range d.rules {
+			if r.match(rel, isDir) {
+				exclude = !r.include
+			}
+		}
+	}
+	return exclude
+}
+
+// hasFilters returns true when any entry may be excluded from the stream.
+func (e *Encoder) hasFilters() bool {
+	return (e.opts.Filter != nil && len(e.opts.Filter.rules) > 0) || len(e.ignoreDirs) > 0
+}
@@ -0,0 +1,72 @@
+package saf
+
+import "testing"
+
+func TestExcluded(t *testing.T) {
+	f := new(Filter)
+	for _, line := range []string{"+ keep.o", "- *.o", "build/"} {
+		if r, ok := parseExcludeFromLine(line); ok {
+			f.rules = append(f.rules, r)
+		}
+	}
+	var rules []filterRule
+	for _, line := range []string{"# comment", "*.log", "!important.log", "/cache", "docs/**/draft*"} {
+		if r, ok := parseIgnoreLine(line); ok {
+			rules = append(rules, r)
+		}
+	}
+	e := &Encoder{opts: EncoderOptions{Filter: f}, ignoreDirs: []ignoreDir{{base: "root/sub", rules: rules}}}
+
+	cases := []struct {
+		pathname string
+		isDir    bool
+		want     bool
+	}{
+		{"root/a.o", false, true},
+		{"root/keep.o", false, false},
+		{"root/build", true, true},
+		{"root/build", false, false},
+		{"root/a.log", false, false}, // above ignore file
+		{"root/sub/a.log", false, true},
+		{"root/sub/deep/a.log", false, true},
+		{"root/sub/important.log", false, false},
+		{"root/sub/cache", true, true},
+		{"root/sub/deep/cache", true, false},
+		{"root/sub/docs/draft1", false, true},
+		{"root/sub/docs/a/b/draft2", false, true},
+		{"root/sub/docs/a/final", false, false},
+	}
+
+	for _, c := range cases {
+		if got := e.excluded(c.pathname, c.isDir); got != c.want {
+			t.Errorf("%s: GOT: %v; WANT: %v", c.pathname, got, c.want)
+		}
+	}
+}
+
+func TestFilterOrder(t *testing.T) {
+	cases := []struct {
+		name  string
+		build func(f *Filter)
+		want  bool // excluded
+	}{
+		{"include first", func(f *Filter) { f.Include("keep.o"); f.Exclude("*.o") }, false},
+		{"exclude first", func(f *Filter) { f.Exclude("*.o"); f.Include("keep.o") }, true},
+		{"no match", func(f *Filter) { f.Exclude("*.c") }, false},
+	}
+
+	for _, c := range cases {
+		f := new(Filter)
+		c.build(f)
+		e := &Encoder{opts: EncoderOptions{Filter: f}}
+		if got := e.excluded("root/keep.o", false); got != c.want {
+			t.Errorf("%s: GOT: %v; WANT: %v", c.name, got, c.want)
+		}
+	}
+
+	// NewFilter tests include patterns before exclude patterns.
+	e := &Encoder{opts: EncoderOptions{Filter: NewFilter([]string{"keep.o"}, []string{"*.o"})}}
+	if got := e.excluded("root/keep.o", false); got {
+		t.Errorf("GOT: %v; WANT: %v", got, false)
+	}
+}
@@ -0,0 +1,104 @@
+// Package saf reads streams and archives in the format written by tsync.
+//
+// A stream is a sequence of gobsp messages. It begins with a header message
+// holding the stream options, followed by a message for each entry, and ends
+// with a trailer message holding the totals and digest of the preceding
+// messages, optionally followed by a signature message. Each entry is named
+// relative to its directory: directory descend and ascend messages bracket
+// the entries inside each directory. An archive written to a file may also
+// have an index message before the trailer, and a fixed size footer message
+// after everything else that locates the index.
+package saf
+
+import (
+	"io"
+	"strings"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// Message types of version 1 of the stream format.
+const (
+	MessageSyn              gobsp.MessageType = iota // 0 sender opens stream with protocol version and stream options
+	MessageSynAck                                    // 1 receiver responds with protocol version and hashes of contents it has
+	MessageRegularFile                               // 2
+	MessageDirectoryDescend                          // 3
+	MessageDirectoryAscend                           // 4
+	MessageSymlink                                   // 5
+	MessageFIFO                                      // 6
+	MessageSocket                                    // 7
+	MessageDevice                                    // 8
+	MessageTrailer                                   // 9 sender closes stream with totals and digest of preceding messages
+	MessageSignature                                 // 10 sender signs trailer
+	MessageIndex                                     // 11 sender lists entries and their offsets
+	MessageFooter                                    // 12 sender locates index at end of archive
+)
+
+// ProtocolVersion is the version of the stream format this package produces
+// and understands.
+const ProtocolVersion = 2 // 2 digests the trailer with SHA-256
+
+// Header holds the stream-level options selected by the sender. It is sent as
+// the first message of every stream, so the recipient can configure itself
+// before decoding any entries.
+type Header struct {
+	Codec Codec         // compression codec sender uses for file contents
+	Hash  HashAlgorithm // algorithm of digest sent with each file
+}
+
+// MarshalBinaryTo writes the protocol version followed by the options as a
+// list of key=value strings.
+func (h *Header) MarshalBinaryTo(iow io.Writer) error {
+	if err := gobsp.Uint32(ProtocolVersion).MarshalBinaryTo(iow); err != nil {
+		return errors.Wrap(err, "cannot encode protocol version")
+	}
+	options := gobsp.StringSlice{
+		gobsp.String("compress=" + h.Codec.String()),
+		gobsp.String("hash=" + h.Hash.String()),
+	}
+	return errors.Wrap(options.MarshalBinaryTo(iow), "cannot encode options")
+}
+
+// UnmarshalBinaryFrom reads the protocol version and options. It returns an
+// error when either the version or any option is not understood, because the
+// remainder of the stream could not be correctly decoded.
+func (h *Header) UnmarshalBinaryFrom(r io.Reader) error {
+	var version gobsp.Uint32
+	if err := version.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode protocol version")
+	}
+	if version != ProtocolVersion {
+		return errors.Errorf("unsupported protocol version: %d", version)
+	}
+
+	var options gobsp.StringSlice
+	if err := options.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode options")
+	}
+
+	for _, option := range options {
+		kv := strings.SplitN(string(option), "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("cannot decode option: %q", option)
+		}
+		switch kv[0] {
+		case "compress":
+			c, err := ParseCodec(kv[1])
+			if err != nil {
+				return err
+			}
+			h.Codec = c
+		case "hash":
+			a, err := ParseHashAlgorithm(kv[1])
+			if err != nil {
+				return err
+			}
+			h.Hash = a
+		default:
+			return errors.Errorf("unsupported option: %q", option)
+		}
+	}
+
+	return nil
+}
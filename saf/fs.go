@@ -0,0 +1,626 @@
+package saf
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// ErrEncrypted is returned when reading an encrypted archive without its
+// secret, or when opening an encrypted archive as a file system.
+var ErrEncrypted = errors.New("archive is encrypted")
+
+// FS is a read-only file system of the entries in an archive. It implements
+// fs.FS, fs.ReadDirFS, and fs.StatFS. The top-level entries of the archive are
+// in the root directory of the file system, and symlinks are followed when
+// they refer to other entries in the archive. The contents of each regular
+// file are verified against their digest every time the file is opened.
+type FS struct {
+	header Header
+	root   *node
+	ra     io.ReaderAt // nil when contents are held in memory
+	closer io.Closer
+}
+
+// OpenFS opens the archive file at pathname as a file system. The contents of
+// regular files are read from the archive as they are opened. The returned
+// file system must be closed when no longer needed.
+func OpenFS(pathname string) (*FS, error) {
+	fh, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := NewFS(fh)
+	if err != nil {
+		_ = fh.Close() // ignore secondary error
+		return nil, err
+	}
+	fsys.closer = fh
+	return fsys, nil
+}
+
+// NewFS reads the archive from r, and returns a file system of its entries.
+// When r implements io.ReaderAt, the archive must begin at offset zero, and
+// the contents of regular files are read from r as they are opened. When r
+// also has a size, such as a file or an io.SectionReader, and the archive has
+// an index, only its header and index are read. Otherwise every message of the
+// archive is read, and when r does not implement io.ReaderAt, the contents of
+// every regular file are held in memory.
+func NewFS(r io.Reader) (*FS, error) {
+	fsys := &FS{root: &node{name: ".", mode: fs.ModeDir | 0555}}
+	if ra, ok := r.(io.ReaderAt); ok {
+		fsys.ra = ra
+		if size, ok := readerSize(r); ok {
+			ix, err := ReadIndex(ra, size)
+			if err == nil {
+				if err = fsys.load(ix); err != nil {
+					return nil, err
+				}
+				return fsys, nil
+			}
+			if err != ErrNoIndex {
+				return nil, err
+			}
+		}
+		r = io.NewSectionReader(ra, 0, math.MaxInt64)
+	}
+	if err := fsys.index(r); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// readerSize returns the size of r when it is known.
+func readerSize(r io.Reader) (int64, bool) {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size(), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := v.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size(), true
+		}
+	}
+	return 0, false
+}
+
+// Close closes the archive file when the file system was opened by OpenFS.
+func (fsys *FS) Close() error {
+	if fsys.closer == nil {
+		return nil
+	}
+	return fsys.closer.Close()
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// index reads every message of the archive and builds the tree of entries.
+func (fsys *FS) index(r io.Reader) error {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr) // used directly by scanner, so offsets are known
+
+	if magic, err := br.Peek(len(cryptMagic)); err == nil && string(magic) == cryptMagic {
+		return ErrEncrypted
+	}
+
+	var haveHeader bool
+	dirs := []*node{fsys.root}
+
+	// add inserts n in the current directory.
+	add := func(n *node) error {
+		if !haveHeader {
+			return errors.New("cannot index entry: received before header")
+		}
+		return insert(dirs[len(dirs)-1], n)
+	}
+
+	// FIFOs and sockets have no contents.
+	special := func(ar io.Reader) error {
+		n, err := decodeNode(ar)
+		if err != nil {
+			return err
+		}
+		return add(n)
+	}
+
+	handlers := map[uint32]gobsp.MessageHandler{
+		uint32(MessageSyn): func(ar io.Reader) error {
+			if haveHeader {
+				return errors.New("cannot index header: received more than once")
+			}
+			haveHeader = true
+			return fsys.header.UnmarshalBinaryFrom(ar)
+		},
+		uint32(MessageRegularFile): func(ar io.Reader) error {
+			n, err := decodeNode(ar)
+			if err != nil {
+				return err
+			}
+			var hash gobsp.String
+			var size gobsp.UVWI
+			var codec gobsp.Uint8
+			if err = hash.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode hash")
+			}
+			if err = size.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode size")
+			}
+			if err = codec.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode codec")
+			}
+			n.digest = []byte(hash)
+			n.size = int64(size)
+			n.codec = Codec(codec)
+			lr, ok := ar.(*io.LimitedReader)
+			if !ok {
+				return errors.Errorf("cannot index contents: cannot determine length of message payload: %T", ar)
+			}
+			n.length = lr.N
+			if fsys.ra != nil {
+				n.offset = cr.n - int64(br.Buffered())
+			} else if n.encoded, err = io.ReadAll(ar); err != nil {
+				return errors.Wrap(err, "cannot read contents")
+			}
+			return add(n)
+		},
+		uint32(MessageDirectoryDescend): func(ar io.Reader) error {
+			var name gobsp.String
+			var mode gobsp.Uint32
+			var mtime gobsp.Int64
+			if err := name.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode name")
+			}
+			if err := mode.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode mode")
+			}
+			if err := mtime.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode modification time")
+			}
+			n := &node{name: string(name), mode: fs.FileMode(mode) | fs.ModeDir, modTime: time.Unix(int64(mtime), 0)}
+			var err error
+			if n.uid, n.gid, err = decodeOwner(ar); err != nil {
+				return err
+			}
+			if err = add(n); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirs[len(dirs)-1].children[n.name])
+			return nil
+		},
+		uint32(MessageDirectoryAscend): func(ar io.Reader) error {
+			if len(dirs) == 1 {
+				return errors.New("cannot ascend above stream root")
+			}
+			dirs = dirs[:len(dirs)-1]
+			return nil
+		},
+		uint32(MessageSymlink): func(ar io.Reader) error {
+			var name, linkname gobsp.String
+			if err := name.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode name")
+			}
+			if err := linkname.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode referent")
+			}
+			n, err := decodeMetadata(ar, string(name))
+			if err != nil {
+				return err
+			}
+			n.linkname = string(linkname)
+			n.size = int64(len(n.linkname))
+			return add(n)
+		},
+		uint32(MessageFIFO):   special,
+		uint32(MessageSocket): special,
+		uint32(MessageDevice): func(ar io.Reader) error {
+			// Devices only send their name.
+			var name gobsp.String
+			if err := name.UnmarshalBinaryFrom(ar); err != nil {
+				return errors.Wrap(err, "cannot decode name")
+			}
+			return add(&node{name: string(name), mode: fs.ModeDevice})
+		},
+		uint32(MessageIndex):     gobsp.DiscardAll,
+		uint32(MessageTrailer):   gobsp.DiscardAll,
+		uint32(MessageSignature): gobsp.DiscardAll,
+		uint32(MessageFooter):    gobsp.DiscardAll,
+	}
+
+	scanner, err := gobsp.NewScanner(br, gobsp.Handlers(handlers))
+	if err != nil {
+		return err
+	}
+	for scanner.Scan() {
+		if err = scanner.Handle(); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if !haveHeader {
+		return errors.New("cannot index archive: header not received")
+	}
+	return nil
+}
+
+// insert adds n to the entries of parent, replacing any entry with the same
+// name.
+func insert(parent, n *node) error {
+	if n.name == "" || n.name == "." || n.name == ".." || strings.Contains(n.name, "/") {
+		return errors.Errorf("cannot index entry: invalid name: %q", n.name)
+	}
+	if parent.children == nil {
+		parent.children = make(map[string]*node)
+	}
+	if existing, ok := parent.children[n.name]; ok && existing.IsDir() && n.IsDir() {
+		// Directory sent again: keep its entries.
+		n.children = existing.children
+	}
+	parent.children[n.name] = n
+	return nil
+}
+
+// load reads the header of the archive, and builds the tree of entries from
+// the index of the archive rather than reading every message.
+func (fsys *FS) load(ix Index) error {
+	mt, payload, _, err := MessageAt(fsys.ra, 0)
+	if err != nil {
+		return errors.Wrap(err, "cannot read header")
+	}
+	if mt != MessageSyn {
+		return errors.New("cannot read header: archive does not begin with header")
+	}
+	if err = fsys.header.UnmarshalBinaryFrom(payload); err != nil {
+		return err
+	}
+
+	dirs := map[string]*node{".": fsys.root}
+	for _, e := range ix {
+		parent, ok := dirs[path.Dir(e.Path)]
+		if !ok {
+			return errors.Errorf("cannot index entry: not in directory: %q", e.Path)
+		}
+		n := &node{
+			name:     path.Base(e.Path),
+			mode:     e.Mode,
+			modTime:  e.ModTime,
+			uid:      e.UID,
+			gid:      e.GID,
+			linkname: e.Linkname,
+		}
+		switch {
+		case e.Mode.IsRegular():
+			n.size, n.digest, n.message = e.Size, e.Hash, e.Offset
+		case e.Mode&fs.ModeSymlink != 0:
+			n.size = int64(len(n.linkname))
+		case e.Mode&fs.ModeDevice != 0:
+			n.mode = fs.ModeDevice
+		}
+		if err = insert(parent, n); err != nil {
+			return err
+		}
+		if n.IsDir() {
+			dirs[e.Path] = parent.children[n.name]
+		}
+	}
+	return nil
+}
+
+// decodeNode reads the name, followed by the modification time, mode, and
+// owner, which begin most entry messages.
+func decodeNode(r io.Reader) (*node, error) {
+	var name gobsp.String
+	if err := name.UnmarshalBinaryFrom(r); err != nil {
+		return nil, errors.Wrap(err, "cannot decode name")
+	}
+	return decodeMetadata(r, string(name))
+}
+
+// decodeMetadata reads the modification time, mode, and owner, which follow
+// the name in most entry messages.
+func decodeMetadata(r io.Reader, name string) (*node, error) {
+	var mtime gobsp.Int64
+	var mode gobsp.Uint32
+	if err := mtime.UnmarshalBinaryFrom(r); err != nil {
+		return nil, errors.Wrap(err, "cannot decode modification time")
+	}
+	if err := mode.UnmarshalBinaryFrom(r); err != nil {
+		return nil, errors.Wrap(err, "cannot decode mode")
+	}
+	n := &node{name: name, mode: fs.FileMode(mode), modTime: time.Unix(int64(mtime), 0)}
+	var err error
+	n.uid, n.gid, err = decodeOwner(r)
+	return n, err
+}
+
+func decodeOwner(r io.Reader) (uint32, uint32, error) {
+	var uid, gid gobsp.Uint32
+	if err := uid.UnmarshalBinaryFrom(r); err != nil {
+		return 0, 0, errors.Wrap(err, "cannot decode user ID")
+	}
+	if err := gid.UnmarshalBinaryFrom(r); err != nil {
+		return 0, 0, errors.Wrap(err, "cannot decode group ID")
+	}
+	return uint32(uid), uint32(gid), nil
+}
+
+// maxSymlinks is the number of symlinks followed while looking up a name
+// before giving up.
+const maxSymlinks = 255
+
+// lookup returns the entry with the specified name. Symlinks in the directory
+// part of name are always followed, while a symlink in the final component is
+// only followed when follow is true.
+func (fsys *FS) lookup(op, name string, follow bool) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	var links int
+	components := strings.Split(name, "/")
+	if name == "." {
+		components = nil
+	}
+
+	n := fsys.root
+	var dir []string // path of n
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+
+		if !n.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		child, ok := n.children[component]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if child.mode&fs.ModeSymlink == 0 || (len(components) == 0 && !follow) {
+			n = child
+			dir = append(dir, component)
+			continue
+		}
+
+		// Restart from the root with the referent followed by the remaining
+		// components.
+		if links++; links > maxSymlinks || path.IsAbs(child.linkname) {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		target := path.Join(append([]string{path.Join(dir...), child.linkname}, components...)...)
+		if target == ".." || strings.HasPrefix(target, "../") {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		n, dir = fsys.root, nil
+		components = nil
+		if target != "." {
+			components = strings.Split(target, "/")
+		}
+	}
+	return n, nil
+}
+
+// Open opens the named entry. Directories may be read with ReadDir, and
+// regular files with Read, Seek, and ReadAt.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	n, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() {
+		return &dirFile{node: n, entries: n.sortedChildren()}, nil
+	}
+	if !n.mode.IsRegular() {
+		// FIFOs, sockets, and devices have no contents in the archive.
+		return &file{node: n, Reader: bytes.NewReader(nil)}, nil
+	}
+	contents, err := fsys.contents(n)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{node: n, Reader: bytes.NewReader(contents)}, nil
+}
+
+// contents returns the decompressed and verified contents of the regular file.
+func (fsys *FS) contents(n *node) ([]byte, error) {
+	codec, offset, length := n.codec, n.offset, n.length
+	if n.message != 0 {
+		// Loaded from the index, so the contents must be located in the
+		// message.
+		var err error
+		if codec, offset, length, err = fsys.locate(n.message); err != nil {
+			return nil, err
+		}
+	}
+	if codec == codecReferenced {
+		return nil, errors.Wrapf(ErrContentsNotSent, "%s:%x", fsys.header.Hash, n.digest)
+	}
+	encoded := n.encoded
+	if encoded == nil {
+		encoded = make([]byte, length)
+		if _, err := fsys.ra.ReadAt(encoded, offset); err != nil {
+			return nil, errors.Wrap(err, "cannot read contents")
+		}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, preallocSize(n.size)))
+	if err := codec.Decompress(buf, bytes.NewReader(encoded), n.size); err != nil {
+		return nil, errors.Wrapf(err, "cannot decompress contents: %s", codec)
+	}
+	if int64(buf.Len()) != n.size {
+		return nil, errors.Errorf("size mismatch: %d != %d", buf.Len(), n.size)
+	}
+	if sum := fsys.header.Hash.Sum(buf.Bytes()); !bytes.Equal(sum, n.digest) {
+		return nil, errors.Errorf("%s mismatch: %x != %x", fsys.header.Hash, n.digest, sum)
+	}
+	return buf.Bytes(), nil
+}
+
+// locate returns the codec, offset, and length of the encoded contents of the
+// regular file message at offset.
+func (fsys *FS) locate(offset int64) (Codec, int64, int64, error) {
+	mt, payload, length, err := MessageAt(fsys.ra, offset)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if mt != MessageRegularFile {
+		return 0, 0, 0, errors.Errorf("index locates message type %d rather than file", mt)
+	}
+	if _, err = decodeNode(payload); err != nil {
+		return 0, 0, 0, err
+	}
+	var hash gobsp.String
+	var size gobsp.UVWI
+	var codec gobsp.Uint8
+	if err = hash.UnmarshalBinaryFrom(payload); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "cannot decode hash")
+	}
+	if err = size.UnmarshalBinaryFrom(payload); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "cannot decode size")
+	}
+	if err = codec.UnmarshalBinaryFrom(payload); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "cannot decode codec")
+	}
+	consumed, _ := payload.Seek(0, io.SeekCurrent) // SectionReader never returns error
+	start := offset + length - payload.Size()
+	return Codec(codec), start + consumed, payload.Size() - consumed, nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := fsys.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return n.sortedChildren(), nil
+}
+
+// Stat returns information about the named entry, following symlinks.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.lookup("stat", name, true)
+}
+
+// Lstat returns information about the named entry without following a symlink
+// in its final component.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	return fsys.lookup("lstat", name, false)
+}
+
+// ReadLink returns the referent of the named symlink.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	n, err := fsys.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return n.linkname, nil
+}
+
+// node is an entry in the archive. It implements both fs.FileInfo and
+// fs.DirEntry.
+type node struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	size     int64
+	uid, gid uint32
+	linkname string
+
+	// Regular files have the digest and codec of their contents, and either
+	// the location of their encoded contents in the archive, the encoded
+	// contents themselves, or when loaded from the index, the location of
+	// their message.
+	digest         []byte
+	codec          Codec
+	offset, length int64
+	encoded        []byte
+	message        int64
+
+	children map[string]*node
+}
+
+func (n *node) Name() string               { return n.name }
+func (n *node) Size() int64                { return n.size }
+func (n *node) Mode() fs.FileMode          { return n.mode }
+func (n *node) ModTime() time.Time         { return n.modTime }
+func (n *node) IsDir() bool                { return n.mode.IsDir() }
+func (n *node) Sys() interface{}           { return nil }
+func (n *node) Type() fs.FileMode          { return n.mode.Type() }
+func (n *node) Info() (fs.FileInfo, error) { return n, nil }
+
+// owner returns the owner of the entry, so streams created from an FS keep
+// the owner of each entry.
+func (n *node) owner() (uint32, uint32) { return n.uid, n.gid }
+
+func (n *node) sortedChildren() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for _, child := range n.children {
+		entries = append(entries, child)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// file is an open regular file.
+type file struct {
+	node *node
+	*bytes.Reader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.node, nil }
+func (f *file) Close() error               { return nil }
+
+// dirFile is an open directory.
+type dirFile struct {
+	node    *node
+	entries []fs.DirEntry
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.node, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns up to count of the remaining entries of the directory, or
+// all of them when count is not positive.
+func (d *dirFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
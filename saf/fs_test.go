@@ -0,0 +1,116 @@
+package saf
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/karrick/gobsp"
+)
+
+// testArchive returns an archive with a directory holding a compressed file, an
+// uncompressed file, and a symlink, followed by a top-level FIFO.
+func testArchive(t *testing.T) []byte {
+	t.Helper()
+	h := Header{Codec: CodecZstd, Hash: HashSHA256}
+
+	buf := new(bytes.Buffer)
+	composer := gobsp.NewComposer(buf)
+	compose := func(mt gobsp.MessageType, fields ...interface{ MarshalBinaryTo(io.Writer) error }) {
+		t.Helper()
+		payload := new(bytes.Buffer)
+		for _, field := range fields {
+			if err := field.MarshalBinaryTo(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := composer.Compose(mt, payload.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := func(name string, contents []byte, codec Codec) {
+		t.Helper()
+		encoded := new(bytes.Buffer)
+		if err := codec.Compress(encoded, contents); err != nil {
+			t.Fatal(err)
+		}
+		payload := new(bytes.Buffer)
+		for _, field := range []interface{ MarshalBinaryTo(io.Writer) error }{
+			gobsp.String(name), gobsp.Int64(1600000000), gobsp.Uint32(0644), gobsp.Uint32(1000), gobsp.Uint32(1000),
+			gobsp.String(h.Hash.Sum(contents)), gobsp.UVWI(len(contents)), gobsp.Uint8(codec),
+		} {
+			if err := field.MarshalBinaryTo(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		payload.Write(encoded.Bytes())
+		if err := composer.Compose(MessageRegularFile, payload.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	compose(MessageSyn, &h)
+	compose(MessageDirectoryDescend, gobsp.String("dir"), gobsp.Uint32(fs.ModeDir|0755), gobsp.Int64(1600000000), gobsp.Uint32(1000), gobsp.Uint32(1000))
+	file("compressed.txt", bytes.Repeat([]byte("hello, world\n"), 100), CodecZstd)
+	file("plain.txt", []byte("plain"), CodecNone)
+	compose(MessageSymlink, gobsp.String("link"), gobsp.String("plain.txt"), gobsp.Int64(1600000000), gobsp.Uint32(fs.ModeSymlink|0777), gobsp.Uint32(1000), gobsp.Uint32(1000))
+	compose(MessageDirectoryAscend, gobsp.Int64(1600000000))
+	compose(MessageFIFO, gobsp.String("fifo"), gobsp.Int64(1600000000), gobsp.Uint32(fs.ModeNamedPipe|0644), gobsp.Uint32(1000), gobsp.Uint32(1000))
+	compose(MessageTrailer, gobsp.Uint64(0))
+	if err := composer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFS(t *testing.T) {
+	archive := testArchive(t)
+
+	for name, r := range map[string]io.Reader{
+		"random access": bytes.NewReader(archive),
+		"in memory":     bytes.NewBuffer(archive),
+	} {
+		t.Run(name, func(t *testing.T) {
+			fsys, err := NewFS(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = fstest.TestFS(fsys, "dir/compressed.txt", "dir/plain.txt", "dir/link"); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := fs.ReadFile(fsys, "dir/link")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "plain"; string(got) != want {
+				t.Errorf("GOT: %q; WANT: %q", got, want)
+			}
+
+			fi, err := fsys.Stat("fifo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fi.Mode().Type(), fs.ModeNamedPipe; got != want {
+				t.Errorf("GOT: %v; WANT: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFSCorrupted(t *testing.T) {
+	archive := testArchive(t)
+	i := bytes.Index(archive, []byte("plain"))
+	i = bytes.Index(archive[i+1:], []byte("plain")) + i + 1 // contents follow the name
+	archive[i] ^= 1
+
+	fsys, err := NewFS(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.ReadFile(fsys, "dir/plain.txt"); err == nil {
+		t.Fatal("GOT: nil; WANT: error")
+	}
+}
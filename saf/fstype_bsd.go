@@ -0,0 +1,22 @@
+// +build darwin dragonfly freebsd
+
+package saf
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsType returns the type of the file system holding pathname.
+func fsType(pathname string) (string, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(pathname, &st); err != nil {
+		return "", err
+	}
+	name := st.Fstypename[:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return string(name), nil
+}
@@ -0,0 +1,56 @@
+package saf
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsMagic maps the magic numbers Linux returns from statfs to the names of
+// common file system types, as shown in /proc/filesystems. Some file systems
+// share a magic number, e.g., devtmpfs is reported as tmpfs. Other types are
+// named by their magic number in hexadecimal.
+var fsMagic = map[uint32]string{
+	0x0187:     "autofs",
+	0x42494e4d: "binfmt_misc",
+	0xcafe4a11: "bpf",
+	0x9123683e: "btrfs",
+	0x27e0eb:   "cgroup",
+	0x63677270: "cgroup2",
+	0xff534d42: "cifs",
+	0x62656570: "configfs",
+	0x64626720: "debugfs",
+	0x1cd1:     "devpts",
+	0xde5e81e4: "efivarfs",
+	0xef53:     "ext4",
+	0x65735546: "fuse",
+	0x958458f6: "hugetlbfs",
+	0x4d44:     "msdos",
+	0x19800202: "mqueue",
+	0x6969:     "nfs",
+	0x6e736673: "nsfs",
+	0x794c7630: "overlay",
+	0x9fa0:     "proc",
+	0x6165676c: "pstore",
+	0x73636673: "securityfs",
+	0xfe534d42: "smb2",
+	0x73717368: "squashfs",
+	0x62656572: "sysfs",
+	0x01021994: "tmpfs",
+	0x74726163: "tracefs",
+	0x58465342: "xfs",
+	0x2fc12fc1: "zfs",
+}
+
+// fsType returns the type of the file system holding pathname.
+func fsType(pathname string) (string, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(pathname, &st); err != nil {
+		return "", err
+	}
+	magic := uint32(st.Type) // signed, and only 32 bits, on some architectures
+	if name, ok := fsMagic[magic]; ok {
+		return name, nil
+	}
+	return fmt.Sprintf("0x%x", magic), nil
+}
@@ -0,0 +1,19 @@
+package saf
+
+import "golang.org/x/sys/unix"
+
+// fsType returns the type of the file system holding pathname.
+func fsType(pathname string) (string, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(pathname, &st); err != nil {
+		return "", err
+	}
+	name := make([]byte, 0, len(st.F_fstypename))
+	for _, c := range st.F_fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return string(name), nil
+}
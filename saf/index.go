@@ -0,0 +1,182 @@
+package saf
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"math"
+	"time"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// IndexEntry describes an entry of an archive and where its message begins.
+type IndexEntry struct {
+	Entry
+	Offset int64 // offset of entry message from start of archive
+}
+
+// Index lists every entry of an archive in the order their messages appear.
+type Index []IndexEntry
+
+// MarshalBinaryTo writes the number of entries followed by each entry.
+func (ix Index) MarshalBinaryTo(iow io.Writer) error {
+	if err := gobsp.UVWI(len(ix)).MarshalBinaryTo(iow); err != nil {
+		return errors.Wrap(err, "cannot encode index length")
+	}
+	for _, e := range ix {
+		mt, err := entryMessageType(e.Mode)
+		if err != nil {
+			return errors.Wrapf(err, "cannot encode index entry: %s", e.Path)
+		}
+		for _, field := range []marshaler{
+			gobsp.String(e.Path),
+			gobsp.UVWI(mt),
+			gobsp.UVWI(e.Offset),
+			gobsp.Uint32(e.Mode),
+			gobsp.Int64(e.ModTime.Unix()),
+			gobsp.Uint32(e.UID),
+			gobsp.Uint32(e.GID),
+			gobsp.UVWI(e.Size),
+			gobsp.String(e.Hash),
+			gobsp.String(e.Linkname),
+		} {
+			if err := field.MarshalBinaryTo(iow); err != nil {
+				return errors.Wrapf(err, "cannot encode index entry: %s", e.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalBinaryFrom reads the entries written by MarshalBinaryTo.
+func (ix *Index) UnmarshalBinaryFrom(r io.Reader) error {
+	var count gobsp.UVWI
+	if err := count.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode index length")
+	}
+	entries := make(Index, 0, minInt(int(count), 1<<16)) // do not trust count for allocation
+	for i := gobsp.UVWI(0); i < count; i++ {
+		var path, hash, linkname gobsp.String
+		var mt, offset, size gobsp.UVWI
+		var mode, uid, gid gobsp.Uint32
+		var mtime gobsp.Int64
+		for _, field := range []unmarshaler{
+			&path, &mt, &offset, &mode, &mtime, &uid, &gid, &size, &hash, &linkname,
+		} {
+			if err := field.UnmarshalBinaryFrom(r); err != nil {
+				return errors.Wrap(err, "cannot decode index entry")
+			}
+		}
+		modeType, ok := entryModeTypes[gobsp.MessageType(mt)]
+		if !ok {
+			return errors.Errorf("cannot decode index entry: message type %d", mt)
+		}
+		entries = append(entries, IndexEntry{
+			Entry: Entry{
+				Path:     string(path),
+				Mode:     fs.FileMode(mode) | modeType,
+				ModTime:  time.Unix(int64(mtime), 0),
+				UID:      uint32(uid),
+				GID:      uint32(gid),
+				Size:     int64(size),
+				Hash:     []byte(hash),
+				Linkname: string(linkname),
+			},
+			Offset: int64(offset),
+		})
+	}
+	*ix = entries
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// footerMagic ends the footer payload, so a reader can tell whether an
+// archive has an index.
+const footerMagic = "TSYNCIX1"
+
+// FooterSize is the number of bytes of the footer message, including its
+// message type and size.
+const FooterSize = 2 + 8 + len(footerMagic)
+
+// ErrNoIndex is returned when an archive does not end with a footer.
+var ErrNoIndex = errors.New("archive has no index")
+
+// FooterPayload returns the payload of the footer message that locates the
+// index message at offset.
+func FooterPayload(offset int64) []byte {
+	buf := new(bytes.Buffer)
+	_ = gobsp.Uint64(offset).MarshalBinaryTo(buf) // bytes.Buffer never returns error
+	buf.WriteString(footerMagic)
+	return buf.Bytes()
+}
+
+// ReadIndex reads the index of the archive in ra, which is size bytes long. It
+// returns ErrNoIndex when the archive does not end with a footer.
+func ReadIndex(ra io.ReaderAt, size int64) (Index, error) {
+	if size < int64(FooterSize) {
+		return nil, ErrNoIndex
+	}
+	footer := make([]byte, FooterSize)
+	if _, err := ra.ReadAt(footer, size-int64(FooterSize)); err != nil {
+		return nil, errors.Wrap(err, "cannot read footer")
+	}
+	if gobsp.MessageType(footer[0]) != MessageFooter || int(footer[1]) != FooterSize-2 || string(footer[10:]) != footerMagic {
+		return nil, ErrNoIndex
+	}
+	var offset gobsp.Uint64
+	_ = offset.UnmarshalBinaryFrom(bytes.NewReader(footer[2:10])) // always has 8 bytes
+
+	mt, payload, _, err := MessageAt(ra, int64(offset))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read index")
+	}
+	if mt != MessageIndex {
+		return nil, errors.Errorf("cannot read index: footer locates message type %d", mt)
+	}
+	var ix Index
+	if err = ix.UnmarshalBinaryFrom(payload); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// MessageAt reads the type and size of the message that begins at offset in
+// ra. It returns the message type, a reader of its payload, and the number of
+// bytes of the entire message.
+func MessageAt(ra io.ReaderAt, offset int64) (gobsp.MessageType, *io.SectionReader, int64, error) {
+	sr := io.NewSectionReader(ra, offset, math.MaxInt64-offset)
+	var mt, size gobsp.UVWI
+	if err := mt.UnmarshalBinaryFrom(sr); err != nil {
+		return 0, nil, 0, errors.Wrap(err, "cannot decode message type")
+	}
+	if err := size.UnmarshalBinaryFrom(sr); err != nil {
+		return 0, nil, 0, errors.Wrap(err, "cannot decode message size")
+	}
+	header, _ := sr.Seek(0, io.SeekCurrent) // SectionReader never returns error
+	return gobsp.MessageType(mt), io.NewSectionReader(ra, offset+header, int64(size)), header + int64(size), nil
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// messageLength returns the number of bytes a composer writes for a message
+// with the specified type and payload size.
+func messageLength(messageType gobsp.MessageType, size int) int64 {
+	var c byteCounter
+	_ = gobsp.UVWI(messageType).MarshalBinaryTo(&c) // byteCounter never returns error
+	_ = gobsp.UVWI(size).MarshalBinaryTo(&c)
+	return int64(c) + int64(size)
+}
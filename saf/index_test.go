@@ -0,0 +1,101 @@
+package saf
+
+import (
+	"bytes"
+	"path"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/karrick/gobsp"
+)
+
+// indexedArchive returns the test archive followed by an index of its entries
+// and the footer that locates the index.
+func indexedArchive(t *testing.T) []byte {
+	t.Helper()
+	archive := testArchive(t)
+	ra := bytes.NewReader(archive)
+
+	var ix Index
+	var dirs []string
+	for offset := int64(0); offset < int64(len(archive)); {
+		mt, payload, length, err := MessageAt(ra, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch mt {
+		case MessageDirectoryAscend:
+			dirs = dirs[:len(dirs)-1]
+		case MessageRegularFile, MessageDirectoryDescend, MessageSymlink, MessageFIFO:
+			entry, err := unmarshalEntry(payload, mt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := entry.Path
+			entry.Path = path.Join(append(dirs, name)...)
+			if mt == MessageDirectoryDescend {
+				dirs = append(dirs, name)
+			}
+			ix = append(ix, IndexEntry{Entry: *entry, Offset: offset})
+		}
+		offset += length
+	}
+
+	buf := bytes.NewBuffer(archive)
+	composer := gobsp.NewComposer(buf)
+	payload := new(bytes.Buffer)
+	if err := ix.MarshalBinaryTo(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := composer.Compose(MessageIndex, payload.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := composer.Compose(MessageFooter, FooterPayload(int64(len(archive)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := composer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadIndex(t *testing.T) {
+	archive := indexedArchive(t)
+
+	ix, err := ReadIndex(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range ix {
+		paths = append(paths, e.Path)
+	}
+	if want := []string{"dir", "dir/compressed.txt", "dir/plain.txt", "dir/link", "fifo"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("GOT: %q; WANT: %q", paths, want)
+	}
+
+	plain := testArchive(t)
+	if _, err = ReadIndex(bytes.NewReader(plain), int64(len(plain))); err != ErrNoIndex {
+		t.Errorf("GOT: %v; WANT: %v", err, ErrNoIndex)
+	}
+}
+
+func TestFSIndexed(t *testing.T) {
+	fsys, err := NewFS(bytes.NewReader(indexedArchive(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := fsys.lookup("stat", "dir/plain.txt", false); err != nil {
+		t.Fatal(err)
+	} else if n.message == 0 {
+		t.Fatal("GOT: file system read every message; WANT: file system loaded from index")
+	}
+	if err = fstest.TestFS(fsys, "dir/compressed.txt", "dir/plain.txt", "dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	// Reading every message must skip the index and footer.
+	if _, err = NewFS(bytes.NewBuffer(indexedArchive(t))); err != nil {
+		t.Fatal(err)
+	}
+}
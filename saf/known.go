@@ -0,0 +1,137 @@
+package saf
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// ErrContentsNotSent is the cause of the error returned when the contents of
+// a regular file are read from a stream that only references them by hash,
+// because the sender was told the destination already has them.
+var ErrContentsNotSent = errors.New("contents not sent")
+
+// KnownHashes holds the hashes of the contents the destination of a stream
+// already has. The receiver sends them to the sender in a SynAck message, so
+// the sender may send each regular file whose hash is known as a reference
+// rather than its contents, which the receiver then creates from the
+// existing file with the same hash.
+type KnownHashes struct {
+	Hash HashAlgorithm // algorithm the hashes were calculated with
+	sums map[string]struct{}
+}
+
+// NewKnownHashes returns an empty set of hashes calculated with the
+// algorithm.
+func NewKnownHashes(hash HashAlgorithm) *KnownHashes {
+	return &KnownHashes{Hash: hash, sums: make(map[string]struct{})}
+}
+
+// Add adds the hash of contents the destination has.
+func (k *KnownHashes) Add(sum []byte) { k.sums[string(sum)] = struct{}{} }
+
+// Has returns true when the destination has contents with the hash. It
+// returns false when k is nil.
+func (k *KnownHashes) Has(sum []byte) bool {
+	if k == nil {
+		return false
+	}
+	_, ok := k.sums[string(sum)]
+	return ok
+}
+
+// Len returns the number of hashes.
+func (k *KnownHashes) Len() int { return len(k.sums) }
+
+// MarshalBinaryTo writes the protocol version, the options as a list of
+// key=value strings, and the sorted list of hashes.
+func (k *KnownHashes) MarshalBinaryTo(iow io.Writer) error {
+	if err := gobsp.Uint32(ProtocolVersion).MarshalBinaryTo(iow); err != nil {
+		return errors.Wrap(err, "cannot encode protocol version")
+	}
+	options := gobsp.StringSlice{gobsp.String("hash=" + k.Hash.String())}
+	if err := options.MarshalBinaryTo(iow); err != nil {
+		return errors.Wrap(err, "cannot encode options")
+	}
+	sums := make(gobsp.StringSlice, 0, len(k.sums))
+	for sum := range k.sums {
+		sums = append(sums, gobsp.String(sum))
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i] < sums[j] })
+	return errors.Wrap(sums.MarshalBinaryTo(iow), "cannot encode hashes")
+}
+
+// UnmarshalBinaryFrom reads the protocol version, options, and hashes. It
+// returns an error when either the version or any option is not understood.
+func (k *KnownHashes) UnmarshalBinaryFrom(r io.Reader) error {
+	var version gobsp.Uint32
+	if err := version.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode protocol version")
+	}
+	if version != ProtocolVersion {
+		return errors.Errorf("unsupported protocol version: %d", version)
+	}
+
+	var options gobsp.StringSlice
+	if err := options.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode options")
+	}
+	for _, option := range options {
+		kv := strings.SplitN(string(option), "=", 2)
+		if len(kv) != 2 || kv[0] != "hash" {
+			return errors.Errorf("unsupported option: %q", option)
+		}
+		a, err := ParseHashAlgorithm(kv[1])
+		if err != nil {
+			return err
+		}
+		k.Hash = a
+	}
+
+	var sums gobsp.StringSlice
+	if err := sums.UnmarshalBinaryFrom(r); err != nil {
+		return errors.Wrap(err, "cannot decode hashes")
+	}
+	k.sums = make(map[string]struct{}, len(sums))
+	for _, sum := range sums {
+		k.sums[string(sum)] = struct{}{}
+	}
+	return nil
+}
+
+// WriteKnownHashes writes the hashes to w as a SynAck message.
+func WriteKnownHashes(w io.Writer, k *KnownHashes) error {
+	buf := new(bytes.Buffer)
+	if err := k.MarshalBinaryTo(buf); err != nil {
+		return errors.Wrap(err, "cannot encode known hashes")
+	}
+	c := gobsp.NewComposer(w)
+	if err := c.Compose(MessageSynAck, buf.Bytes()); err != nil {
+		return errors.Wrap(err, "cannot write known hashes")
+	}
+	return errors.Wrap(c.Close(), "cannot write known hashes")
+}
+
+// ReadKnownHashes reads the hashes from the SynAck message written by
+// WriteKnownHashes.
+func ReadKnownHashes(r io.Reader) (*KnownHashes, error) {
+	var mt, size gobsp.UVWI
+	if err := mt.UnmarshalBinaryFrom(r); err != nil {
+		return nil, errors.Wrap(err, "cannot read known hashes")
+	}
+	if err := size.UnmarshalBinaryFrom(r); err != nil {
+		return nil, errors.Wrap(err, "cannot read known hashes")
+	}
+	if gobsp.MessageType(mt) != MessageSynAck {
+		return nil, errors.Errorf("cannot read known hashes: message type %d rather than %d", mt, MessageSynAck)
+	}
+	k := new(KnownHashes)
+	if err := k.UnmarshalBinaryFrom(io.LimitReader(r, int64(size))); err != nil {
+		return nil, errors.Wrap(err, "cannot decode known hashes")
+	}
+	return k, nil
+}
@@ -0,0 +1,137 @@
+package saf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestKnownHashesRoundTrip(t *testing.T) {
+	k := NewKnownHashes(HashSHA256)
+	k.Add(HashSHA256.Sum([]byte("one")))
+	k.Add(HashSHA256.Sum([]byte("two")))
+
+	buf := new(bytes.Buffer)
+	if err := WriteKnownHashes(buf, k); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadKnownHashes(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hash != HashSHA256 {
+		t.Errorf("GOT: %s; WANT: %s", got.Hash, HashSHA256)
+	}
+	if got.Len() != 2 || !got.Has(HashSHA256.Sum([]byte("one"))) || !got.Has(HashSHA256.Sum([]byte("two"))) {
+		t.Errorf("GOT: %d hashes; WANT: both hashes", got.Len())
+	}
+	if got.Has(HashSHA256.Sum([]byte("three"))) {
+		t.Errorf("GOT: unknown hash; WANT: not found")
+	}
+
+	// A stream is not a set of known hashes.
+	stream := new(bytes.Buffer)
+	e, err := NewEncoder(stream, EncoderOptions{})
+	if err == nil {
+		err = e.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadKnownHashes(stream); err == nil {
+		t.Errorf("GOT: %v; WANT: error", err)
+	}
+}
+
+func TestKnownHashes(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	contents := strings.Repeat("contents", 64)
+
+	root := t.TempDir()
+	moved := filepath.Join(root, "moved")
+	if err := ioutil.WriteFile(moved, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	known := NewDedupSink(root, DedupNone, "", nil).KnownHashes(HashXXH64)
+	if known.Len() != 1 {
+		t.Fatalf("GOT: %d known hashes; WANT: 1", known.Len())
+	}
+
+	encode := func(t *testing.T, known *KnownHashes) []byte {
+		t.Helper()
+		stream := new(bytes.Buffer)
+		e, err := NewEncoder(stream, EncoderOptions{KnownHashes: known})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.AddEntry(&Entry{Path: "top/a", Mode: 0644, ModTime: mtime, Size: int64(len(contents))}, strings.NewReader(contents))
+		if err == nil {
+			err = e.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream.Bytes()
+	}
+	referenced := encode(t, known)
+	if sent := encode(t, nil); len(referenced) >= len(sent)-len(contents) {
+		t.Errorf("GOT: %d bytes; WANT: fewer than %d", len(referenced), len(sent)-len(contents))
+	}
+
+	t.Run("hash mismatch", func(t *testing.T) {
+		_, err := NewEncoder(new(bytes.Buffer), EncoderOptions{Hash: HashSHA256, KnownHashes: known})
+		if err == nil {
+			t.Errorf("GOT: %v; WANT: error", err)
+		}
+	})
+
+	t.Run("found", func(t *testing.T) {
+		d, err := NewDecoder(bytes.NewReader(referenced), DecoderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = d.Decode(NewExtractor(NewDedupSink(root, DedupReflink, "", nil), ExtractorOptions{})); err != nil {
+			t.Fatal(err)
+		}
+		pathname := filepath.Join(root, "top", "a")
+		got, err := ioutil.ReadFile(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != contents {
+			t.Errorf("GOT: %q; WANT: %q", got, contents)
+		}
+		fi, err := os.Stat(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("GOT: %s; WANT: %s", fi.ModTime(), mtime)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		var failed []Event
+		d, err := NewDecoder(bytes.NewReader(referenced), DecoderOptions{Events: func(ev Event) {
+			if ev.Action == ActionFailed {
+				failed = append(failed, ev)
+			}
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink := NewDedupSink(t.TempDir(), DedupReflink, "", nil)
+		if err = d.Decode(NewExtractor(sink, ExtractorOptions{})); err != nil {
+			t.Fatal(err)
+		}
+		if len(failed) != 1 || failed[0].Path != "top/a" || !errors.Is(failed[0].Err, ErrContentsNotSent) {
+			t.Errorf("GOT: %v; WANT: top/a not sent", failed)
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package saf
+
+// Logger receives the diagnostic messages of an Encoder, Decoder, or
+// Extractor. Each format string ends with a newline. Warnings describe
+// entries that could not be encoded or decoded, which do not stop the rest of
+// the stream from being processed.
+type Logger interface {
+	Debugf(format string, a ...interface{})
+	Verbosef(format string, a ...interface{})
+	Warningf(format string, a ...interface{})
+}
+
+// nopLogger discards every message, and is used when no Logger is provided.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{})   {}
+func (nopLogger) Verbosef(string, ...interface{}) {}
+func (nopLogger) Warningf(string, ...interface{}) {}
+
+func loggerOrNop(log Logger) Logger {
+	if log == nil {
+		return nopLogger{}
+	}
+	return log
+}
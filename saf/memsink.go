@@ -0,0 +1,97 @@
+package saf
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// MemorySink is a Sink that holds the entries it receives in memory, keyed
+// by their slash separated path, which is useful for testing code that
+// extracts streams.
+type MemorySink struct {
+	Entries map[string]*MemoryEntry
+}
+
+// MemoryEntry is an entry held by a MemorySink.
+type MemoryEntry struct {
+	Mode     fs.FileMode
+	ModTime  time.Time
+	Linkname string
+	Contents []byte
+}
+
+// NewMemorySink returns an empty MemorySink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{Entries: make(map[string]*MemoryEntry)}
+}
+
+// create adds the entry after checking its directory exists, replacing any
+// entry of a different type with the same name, along with its descendants.
+func (ms *MemorySink) create(op, pathname string, entry *MemoryEntry) error {
+	if dir := path.Dir(pathname); dir != "." {
+		if parent, ok := ms.Entries[dir]; !ok || !parent.Mode.IsDir() {
+			return &fs.PathError{Op: op, Path: pathname, Err: fs.ErrNotExist}
+		}
+	}
+	if existing, ok := ms.Entries[pathname]; ok && existing.Mode.Type() != entry.Mode.Type() {
+		for name := range ms.Entries {
+			if strings.HasPrefix(name, pathname+"/") {
+				delete(ms.Entries, name)
+			}
+		}
+	}
+	ms.Entries[pathname] = entry
+	return nil
+}
+
+// Mkdir adds the directory unless it already exists.
+func (ms *MemorySink) Mkdir(pathname string, mode fs.FileMode) error {
+	if existing, ok := ms.Entries[pathname]; ok && existing.Mode.IsDir() {
+		return nil
+	}
+	return ms.create("mkdir", pathname, &MemoryEntry{Mode: fs.ModeDir | mode.Perm()})
+}
+
+// CreateFile adds the regular file with contents.
+func (ms *MemorySink) CreateFile(pathname string, contents io.Reader) error {
+	buf, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+	return ms.create("create", pathname, &MemoryEntry{Contents: buf})
+}
+
+// Symlink adds the symlink.
+func (ms *MemorySink) Symlink(linkname, pathname string) error {
+	return ms.create("symlink", pathname, &MemoryEntry{Mode: fs.ModeSymlink | 0777, Linkname: linkname})
+}
+
+// Mkfifo adds the FIFO.
+func (ms *MemorySink) Mkfifo(pathname string, mode fs.FileMode) error {
+	return ms.create("mkfifo", pathname, &MemoryEntry{Mode: fs.ModeNamedPipe | mode.Perm()})
+}
+
+// SetMetadata sets the permissions and modification time of the entry.
+func (ms *MemorySink) SetMetadata(pathname string, mode fs.FileMode, mtime time.Time) error {
+	entry, ok := ms.Entries[pathname]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: pathname, Err: fs.ErrNotExist}
+	}
+	entry.Mode = entry.Mode.Type() | mode.Perm()
+	entry.ModTime = mtime
+	return nil
+}
+
+// Ascend sets the modification time of the directory.
+func (ms *MemorySink) Ascend(pathname string, mtime time.Time) error {
+	entry, ok := ms.Entries[pathname]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: pathname, Err: fs.ErrNotExist}
+	}
+	entry.ModTime = mtime
+	return nil
+}
@@ -0,0 +1,43 @@
+package saf
+
+import (
+	"os"
+	"strings"
+)
+
+// enterDevice records the device of the directory being encoded, and returns
+// true when its contents should not be encoded because it is the mount point
+// of another file system, and either OneFileSystem is set or the type of the
+// mounted file system is listed in SkipFstypes. The directory itself is still
+// encoded, so the mount point is created when extracted. Every call must be
+// followed by a call to leaveDevice.
+func (e *Encoder) enterDevice(targetFull string, fi os.FileInfo) bool {
+	dev := device(fi)
+	mounted := len(e.deviceStack) == 0 || e.deviceStack[len(e.deviceStack)-1] != dev
+	e.deviceStack = append(e.deviceStack, dev)
+
+	if e.opts.OneFileSystem && dev != e.deviceStack[0] {
+		e.log.Verbosef("%s: skipping contents on another file system\n", targetFull)
+		return true
+	}
+	if len(e.opts.SkipFstypes) == 0 || !mounted {
+		// File system type can only change at a mount point.
+		return false
+	}
+	name, err := fsType(targetFull)
+	if err != nil {
+		e.log.Warningf("%s: cannot determine file system type: %s\n", targetFull, err)
+		return false
+	}
+	for _, skipped := range e.opts.SkipFstypes {
+		if strings.EqualFold(name, skipped) {
+			e.log.Verbosef("%s: skipping contents on %s file system\n", targetFull, name)
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Encoder) leaveDevice() {
+	e.deviceStack = e.deviceStack[:len(e.deviceStack)-1]
+}
@@ -0,0 +1,76 @@
+package saf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnterDevice(t *testing.T) {
+	top := filepath.Join(t.TempDir(), "top")
+	if err := os.Mkdir(top, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(top, "c"), []byte("top/c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fstype, err := fsType(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fstype == "" {
+		t.Skip("file system type not supported")
+	}
+
+	cases := []struct {
+		name string
+		opts EncoderOptions
+		want string
+	}{
+		{"default", EncoderOptions{}, "top/,top/c,.."},
+		{"one file system", EncoderOptions{OneFileSystem: true}, "top/,top/c,.."},
+		{"skip other fstype", EncoderOptions{SkipFstypes: []string{"no-such-fs"}}, "top/,top/c,.."},
+		{"skip fstype", EncoderOptions{SkipFstypes: []string{"no-such-fs", fstype}}, "top/,.."},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			e, err := NewEncoder(buf, c.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = e.AddPath(top); err != nil {
+				t.Fatal(err)
+			}
+			if err = e.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeEntries(t, buf, DecoderOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("GOT: %s; WANT: %s", got, c.want)
+			}
+		})
+	}
+
+	t.Run("one file system, other device", func(t *testing.T) {
+		e, err := NewEncoder(new(bytes.Buffer), EncoderOptions{OneFileSystem: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(top)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.deviceStack = []uint64{device(fi) + 1} // as if descending from another file system
+		if !e.enterDevice(top, fi) {
+			t.Errorf("GOT: false; WANT: true")
+		}
+		e.leaveDevice()
+	})
+}
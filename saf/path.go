@@ -0,0 +1,234 @@
+package saf
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/errors"
+)
+
+// AddPath sends the file system entry at pathname as a top-level entry of the
+// stream, and when it is a directory, every entry below it that is not
+// filtered out. It returns an error when pathname itself cannot be sent, but
+// only reports entries below it that cannot be sent to the Logger as
+// warnings. Any directories of entries added by AddEntry are ascended out of
+// first.
+func (e *Encoder) AddPath(pathname string) error {
+	for e.err == nil && len(e.dirs) > 0 {
+		_ = e.ascendEntry() // error is also recorded in e.err
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	target, err := filepath.Abs(pathname)
+	if err != nil {
+		return err
+	}
+	de, err := godirwalk.NewDirent(target)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode")
+	}
+	e.filterRoot = filepath.Dir(target)
+	e.targetRoot = target
+
+	modeType := de.ModeType()
+	if de.IsSymlink() && (e.opts.Dereference == DereferenceAll || e.opts.Dereference == DereferenceArgs) {
+		if modeType, err = e.referentType(target); err != nil {
+			return err
+		}
+	}
+	return e.encodeEntry(e.filterRoot, de.Name(), modeType)
+}
+
+func (e *Encoder) encodeDirent(targetParent string, de *godirwalk.Dirent) error {
+	modeType := de.ModeType()
+	if de.IsSymlink() {
+		targetFull := filepath.Join(targetParent, de.Name())
+		follow, err := e.dereference(targetFull)
+		if err != nil {
+			return err
+		}
+		if follow {
+			if modeType, err = e.referentType(targetFull); err != nil {
+				return err
+			}
+		}
+	}
+	return e.encodeEntry(targetParent, de.Name(), modeType)
+}
+
+// encodeEntry encodes the file system entry as the specified file mode type,
+// which is the type of the referent when a symlink is dereferenced.
+func (e *Encoder) encodeEntry(targetParent, targetBase string, modeType os.FileMode) error {
+	e.entryStart = time.Now()
+	if modeType.IsRegular() {
+		return errors.Wrap(e.encodeFile(targetParent, targetBase), "cannot encode file")
+	} else if modeType.IsDir() {
+		return errors.Wrap(e.encodeDirectory(targetParent, targetBase), "cannot encode directory")
+	} else if modeType&os.ModeSymlink != 0 {
+		return errors.Wrap(e.encodeSymlink(targetParent, targetBase), "cannot encode symlink")
+	} else if modeType&os.ModeNamedPipe != 0 {
+		return errors.Wrap(e.encodeSpecial(targetParent, targetBase, "fifo"), "cannot encode FIFO")
+	} else if modeType&os.ModeSocket != 0 {
+		return errors.Wrap(e.encodeSpecial(targetParent, targetBase, "socket"), "cannot encode socket")
+	} else if modeType&os.ModeDevice != 0 {
+		// TODO: add support
+	}
+	return errors.Errorf("cannot encode item: file mode type not supported: %s", modeType)
+}
+
+// infoEntry returns the entry describing the file system entry at targetFull.
+func (e *Encoder) infoEntry(targetFull string, fi os.FileInfo) *Entry {
+	uid, gid := owner(fi)
+	return &Entry{
+		Path:    e.filterPath(targetFull),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+		UID:     uid,
+		GID:     gid,
+	}
+}
+
+// encodeDirectory encodes the directory, including all of its children. If
+// something prevents encoding the directory, then return early. When one of
+// the children of the directory fails to encode, emit a warning message, but
+// continue on to the other children.
+func (e *Encoder) encodeDirectory(targetParent, targetBase string) error {
+	targetFull := filepath.Join(targetParent, targetBase)
+	e.log.Debugf("%s encode directory\n", targetFull)
+
+	fi, err := os.Stat(targetFull)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = e.enterDirectory(targetFull, fi); err != nil {
+		return err
+	}
+	defer e.leaveDirectory(fi)
+
+	var deChildren godirwalk.Dirents
+	skip := e.enterDevice(targetFull, fi)
+	defer e.leaveDevice()
+	if !skip {
+		deChildren, err = godirwalk.ReadDirents(targetFull, e.dirReadScratch)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err = e.sendEntry(e.infoEntry(targetFull, fi), targetFull); err != nil {
+		return err
+	}
+
+	pushed, err := e.pushIgnoreFile(targetFull)
+	if err != nil {
+		e.log.Warningf("%s\n", err)
+	}
+
+	if e.opts.Sorted {
+		sort.Sort(deChildren)
+	}
+
+	for _, deChild := range deChildren {
+		if e.err != nil {
+			break // stream cannot be completed
+		}
+		childFull := filepath.Join(targetFull, deChild.Name())
+		if e.hasFilters() && e.excluded(e.filterPath(childFull), deChild.IsDir()) {
+			e.log.Debugf("%s excluded\n", childFull)
+			e.skipped(e.filterPath(childFull), deChild.ModeType())
+			continue
+		}
+		start := time.Now()
+		if err = e.encodeDirent(targetFull, deChild); err != nil {
+			e.failed(e.filterPath(childFull), deChild.ModeType(), time.Since(start), err)
+			e.log.Warningf("%s: %+s\n", filepath.Join(targetFull, deChild.Name()), err)
+		}
+	}
+
+	if pushed {
+		e.popIgnoreFile()
+	}
+
+	// When leaving a directory, send its modification time. There is no error
+	// recovery for this not working, because sender and recipient would be in
+	// different directories, so the error is recorded in e.err.
+	return e.sendAscend(fi.ModTime())
+}
+
+func (e *Encoder) encodeFile(targetParent, targetBase string) error {
+	targetFull := filepath.Join(targetParent, targetBase)
+	e.log.Debugf("%s encode file\n", targetFull)
+
+	if e.measuring {
+		fi, err := os.Stat(targetFull)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		entry := e.infoEntry(targetFull, fi)
+		entry.Size = fi.Size()
+		return e.sendEntry(entry, targetFull)
+	}
+	if e.visitor != nil {
+		return e.copyFile(targetFull)
+	}
+
+	fh, err := os.Open(targetFull)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	fi, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close() // ignore secondary error
+		return errors.WithStack(err)
+	}
+
+	err = e.readContents(fh, fi.Size())
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return e.sendEntry(e.infoEntry(targetFull, fi), targetFull)
+}
+
+func (e *Encoder) encodeSymlink(targetParent, targetBase string) error {
+	targetFull := filepath.Join(targetParent, targetBase)
+	e.log.Debugf("%s encode symlink\n", targetFull)
+
+	li, err := os.Lstat(targetFull)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	linkname, err := os.Readlink(targetFull)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	e.log.Debugf("%s referent: %v\n", targetFull, linkname)
+
+	entry := e.infoEntry(targetFull, li)
+	entry.Linkname = linkname
+	return e.sendEntry(entry, targetFull)
+}
+
+// encodeSpecial encodes a FIFO or socket, which have no contents.
+func (e *Encoder) encodeSpecial(targetParent, targetBase, kind string) error {
+	targetFull := filepath.Join(targetParent, targetBase)
+	e.log.Debugf("%s encode %s\n", targetFull, kind)
+
+	fi, err := os.Stat(targetFull)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return e.sendEntry(e.infoEntry(targetFull, fi), targetFull)
+}
@@ -0,0 +1,30 @@
+package saf
+
+// Progress counts the entries sent by an Encoder, or visited by a Decoder.
+type Progress struct {
+	Entries int64  // number of entries
+	Bytes   int64  // size of the contents of regular files
+	Path    string // path of the most recent entry
+}
+
+func (p *Progress) add(entry *Entry) {
+	p.Entries++
+	if entry.Mode.IsRegular() {
+		p.Bytes += entry.Size
+	}
+	p.Path = entry.Path
+}
+
+// MeasurePaths returns the number of entries and bytes of file contents that
+// AddPath would send for each of the pathnames with the same options, without
+// reading the contents of any file, so the progress of encoding them may be
+// compared against the total. Entries that cannot be read are not counted.
+func MeasurePaths(opts EncoderOptions, pathnames ...string) Progress {
+	opts.Logger, opts.Progress, opts.Events = nil, nil, nil
+	e := newEncoder(opts)
+	e.measuring = true
+	for _, pathname := range pathnames {
+		_ = e.AddPath(pathname) // errors are reported when encoding
+	}
+	return e.progress
+}
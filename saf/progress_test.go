@@ -0,0 +1,102 @@
+package saf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	root := t.TempDir()
+	for name, contents := range map[string]string{
+		"top/a/b":        "top/a/b",
+		"top/a/skip.tmp": "skip",
+		"top/c":          "top/c",
+	} {
+		pathname := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pathname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pathname, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := filepath.Join(root, "top")
+	want := Progress{Entries: 4, Bytes: 12}
+
+	opts := EncoderOptions{Filter: NewFilter(nil, []string{"*.tmp"})}
+	if got := MeasurePaths(opts, target); got.Entries != want.Entries || got.Bytes != want.Bytes {
+		t.Errorf("MeasurePaths GOT: %+v; WANT: %+v", got, want)
+	}
+
+	var encoded Progress
+	opts.Progress = func(p Progress) { encoded = p }
+	buf := new(bytes.Buffer)
+	e, err := NewEncoder(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddPath(target); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if encoded.Entries != want.Entries || encoded.Bytes != want.Bytes {
+		t.Errorf("Encoder GOT: %+v; WANT: %+v", encoded, want)
+	}
+	if got, want := e.Stats(), (Stats{Directories: 2, Files: 2, Bytes: 12, Skipped: 1}); got != want {
+		t.Errorf("Stats GOT: %+v; WANT: %+v", got, want)
+	}
+
+	var decoded Progress
+	if _, err = decodeEntries(t, buf, DecoderOptions{Progress: func(p Progress) { decoded = p }}); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != encoded {
+		t.Errorf("Decoder GOT: %+v; WANT: %+v", decoded, encoded)
+	}
+
+	t.Run("stripped", func(t *testing.T) {
+		rw, err := NewRewriter(1, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := EncoderOptions{Filter: NewFilter(nil, []string{"*.tmp"}), Rewriter: rw}
+		want := Progress{Entries: 3, Bytes: 12} // top is not sent
+
+		if got := MeasurePaths(opts, target); got.Entries != want.Entries || got.Bytes != want.Bytes {
+			t.Errorf("MeasurePaths GOT: %+v; WANT: %+v", got, want)
+		}
+
+		var encoded Progress
+		var events int
+		opts.Progress = func(p Progress) { encoded = p }
+		opts.Events = func(ev Event) {
+			if ev.Action == ActionEncoded {
+				events++
+			}
+		}
+		e, err := NewEncoder(new(bytes.Buffer), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.AddPath(target); err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if encoded.Entries != want.Entries || encoded.Bytes != want.Bytes {
+			t.Errorf("Encoder GOT: %+v; WANT: %+v", encoded, want)
+		}
+		if got, want := e.Stats(), (Stats{Directories: 1, Files: 2, Bytes: 12, Skipped: 1}); got != want {
+			t.Errorf("Stats GOT: %+v; WANT: %+v", got, want)
+		}
+		if events != 3 {
+			t.Errorf("Events GOT: %d; WANT: 3", events)
+		}
+	})
+}
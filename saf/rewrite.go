@@ -0,0 +1,344 @@
+package saf
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// Rewriter renames entries as they are encoded or decoded. Leading path
+// components are first stripped, the top-level entry is then renamed, and
+// finally each transform is applied to the resulting path. Because entries
+// are sent relative to their directory, a rewritten path must remain in the
+// rewritten directory of its parent. Entries rewritten to an empty path are
+// skipped. A Rewriter may be shared, because each Encoder and Decoder keeps
+// its own state while renaming.
+type Rewriter struct {
+	strip      int
+	as         string
+	transforms []transform
+}
+
+// NewRewriter returns a rewriter that strips the specified number of leading
+// components, renames top-level entries to as when it is not empty, and then
+// applies the semicolon separated sed style substitutions in transforms. It
+// returns nil when no entries would be renamed.
+func NewRewriter(strip int, as, transforms string) (*Rewriter, error) {
+	if strip < 0 {
+		return nil, errors.Errorf("cannot strip negative number of components: %d", strip)
+	}
+	if strings.Contains(as, "/") {
+		return nil, errors.Errorf("cannot rename top-level entries to name with slash: %q", as)
+	}
+	parsed, err := parseTransforms(transforms)
+	if err != nil {
+		return nil, err
+	}
+	if strip == 0 && as == "" && len(parsed) == 0 {
+		return nil, nil
+	}
+	return &Rewriter{strip: strip, as: as, transforms: parsed}, nil
+}
+
+// rewriter is the state of a Rewriter while renaming the entries of a single
+// stream.
+type rewriter struct {
+	*Rewriter
+	log  Logger
+	dirs []rewriteDir
+}
+
+// rewriteDir is a directory the stream has descended into.
+type rewriteDir struct {
+	name  string // name in the stream
+	path  string // rewritten path, or empty when directory is skipped
+	prune bool   // true when every descendant is skipped
+}
+
+// start returns the state for renaming the entries of a new stream, or nil
+// when rw is nil.
+func (rw *Rewriter) start(log Logger) *rewriter {
+	if rw == nil {
+		return nil
+	}
+	return &rewriter{Rewriter: rw, log: loggerOrNop(log)}
+}
+
+// entry returns the new name of the entry with the specified name in the
+// current directory, and false when the entry should be skipped. When the
+// entry is a directory, the rewriter descends into it, and ascend must be
+// called when the stream ascends out of it.
+func (rw *rewriter) entry(messageType gobsp.MessageType, name string) (string, bool) {
+	newName, ok, prune := rw.rename(name)
+	if messageType == MessageDirectoryDescend {
+		d := rewriteDir{name: name, prune: prune}
+		if ok {
+			d.path = path.Join(rw.parentPath(), newName)
+		}
+		rw.dirs = append(rw.dirs, d)
+	}
+	return newName, ok
+}
+
+// rename returns the new name of the entry, and false when the entry should
+// be skipped. When a skipped directory is stripped, or rewritten to an empty
+// name, its descendants are still renamed, but otherwise prune is true and
+// its descendants are skipped as well.
+func (rw *rewriter) rename(name string) (string, bool, bool) {
+	depth := len(rw.dirs)
+	if depth > 0 && rw.dirs[depth-1].prune {
+		return "", false, true
+	}
+	if depth < rw.strip {
+		return "", false, false
+	}
+
+	components := make([]string, 0, depth-rw.strip+1)
+	for _, d := range rw.dirs[rw.strip:] {
+		components = append(components, d.name)
+	}
+	components = append(components, name)
+	if rw.as != "" {
+		components[0] = rw.as
+	}
+
+	original := path.Join(append(rw.names(), name)...)
+	rewritten := path.Join(components...)
+	for _, t := range rw.transforms {
+		rewritten = t.apply(rewritten)
+	}
+	if rewritten = strings.Trim(path.Clean("/"+rewritten), "/"); rewritten == "" {
+		rw.log.Debugf("%s rewritten to empty name\n", original)
+		return "", false, false
+	}
+
+	dir := path.Dir(rewritten)
+	if dir == "." {
+		dir = ""
+	}
+	if dir != rw.parentPath() {
+		rw.log.Warningf("%s: cannot rewrite to %s: not in directory %q\n", original, rewritten, rw.parentPath())
+		return "", false, true
+	}
+	newName := path.Base(rewritten)
+	if newName != name {
+		rw.log.Debugf("%s rewritten to %s\n", original, rewritten)
+	}
+	return newName, true, false
+}
+
+// ascend returns true when the directory being ascended out of was not
+// skipped.
+func (rw *rewriter) ascend() (bool, error) {
+	if len(rw.dirs) == 0 {
+		return false, errors.New("cannot ascend above stream root")
+	}
+	d := rw.dirs[len(rw.dirs)-1]
+	rw.dirs = rw.dirs[:len(rw.dirs)-1]
+	return d.path != "", nil
+}
+
+// parentPath returns the rewritten path of the current directory.
+func (rw *rewriter) parentPath() string {
+	for i := len(rw.dirs) - 1; i >= 0; i-- {
+		if rw.dirs[i].path != "" {
+			return rw.dirs[i].path
+		}
+	}
+	return ""
+}
+
+func (rw *rewriter) names() []string {
+	names := make([]string, len(rw.dirs))
+	for i, d := range rw.dirs {
+		names[i] = d.name
+	}
+	return names
+}
+
+// rewriteMessage returns the message with the entry renamed, and false when
+// the message should not be sent.
+func (rw *rewriter) rewriteMessage(messageType gobsp.MessageType, message []byte) ([]byte, bool, error) {
+	switch messageType {
+	case MessageDirectoryAscend:
+		ok, err := rw.ascend()
+		return message, ok, err
+	case MessageRegularFile, MessageDirectoryDescend, MessageSymlink, MessageFIFO, MessageSocket, MessageDevice:
+	default:
+		return message, true, nil
+	}
+
+	// Every entry message begins with the entry name.
+	br := bytes.NewReader(message)
+	var name gobsp.String
+	if err := name.UnmarshalBinaryFrom(br); err != nil {
+		return nil, false, errors.Wrap(err, "cannot decode name")
+	}
+	newName, ok := rw.entry(messageType, string(name))
+	if !ok || newName == string(name) {
+		return message, ok, nil
+	}
+	rest := message[len(message)-br.Len():]
+	buf := bytes.NewBuffer(make([]byte, 0, len(rest)+len(newName)+8))
+	_ = gobsp.String(newName).MarshalBinaryTo(buf) // bytes.Buffer never returns error
+	_, _ = buf.Write(rest)
+	return buf.Bytes(), true, nil
+}
+
+// rewriting returns the handlers with each entry handler wrapped so it is
+// invoked with the renamed entry, and is not invoked for skipped entries.
+func (rw *rewriter) rewriting(handlers map[gobsp.MessageType]gobsp.MessageHandler) map[gobsp.MessageType]gobsp.MessageHandler {
+	wrapped := make(map[gobsp.MessageType]gobsp.MessageHandler, len(handlers))
+
+	for messageType, handler := range handlers {
+		messageType, handler := messageType, handler
+
+		switch messageType {
+		case MessageDirectoryAscend:
+			wrapped[messageType] = func(r io.Reader) error {
+				ok, err := rw.ascend()
+				if err != nil || !ok {
+					return err
+				}
+				return handler(r)
+			}
+		default:
+			wrapped[messageType] = func(r io.Reader) error {
+				// Every entry message begins with the entry name.
+				var name gobsp.String
+				if err := name.UnmarshalBinaryFrom(r); err != nil {
+					return errors.Wrap(err, "cannot decode name")
+				}
+				newName, ok := rw.entry(messageType, string(name))
+				if !ok {
+					return nil
+				}
+				prefix := new(bytes.Buffer)
+				_ = gobsp.String(newName).MarshalBinaryTo(prefix) // bytes.Buffer never returns error
+				return handler(io.MultiReader(prefix, r))
+			}
+		}
+	}
+
+	return wrapped
+}
+
+// transform is a sed style substitution applied to entry paths.
+type transform struct {
+	re          *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+func (t transform) apply(pathname string) string {
+	if t.global {
+		return t.re.ReplaceAllString(pathname, t.replacement)
+	}
+	loc := t.re.FindStringSubmatchIndex(pathname)
+	if loc == nil {
+		return pathname
+	}
+	dst := t.re.ExpandString(nil, t.replacement, pathname, loc)
+	return pathname[:loc[0]] + string(dst) + pathname[loc[1]:]
+}
+
+// parseTransforms parses semicolon separated sed style substitutions, such as
+// `s/^out/release/;s/\.txt$/.md/g`. Any character may be used as the
+// delimiter. In the replacement, `&` is the matched text and `\1` through
+// `\9` are the matched groups. The flags are `g` to replace every match
+// rather than only the first, and `i` to ignore case.
+func parseTransforms(value string) ([]transform, error) {
+	var transforms []transform
+	for value != "" {
+		if value[0] == ';' {
+			value = value[1:]
+			continue
+		}
+		if len(value) < 2 || value[0] != 's' {
+			return nil, errors.Errorf("cannot parse transform: %q", value)
+		}
+		delim := value[1]
+		fields, rest, err := splitTransform(value[2:], delim)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse transform: %q", value)
+		}
+
+		var t transform
+		var flags string
+		for rest != "" && rest[0] != ';' {
+			switch rest[0] {
+			case 'g':
+				t.global = true
+			case 'i':
+				flags = "(?i)"
+			default:
+				return nil, errors.Errorf("cannot parse transform: unknown flag: %q", rest[0])
+			}
+			rest = rest[1:]
+		}
+		if t.re, err = regexp.Compile(flags + fields[0]); err != nil {
+			return nil, errors.Wrap(err, "cannot parse transform")
+		}
+		t.replacement = sedReplacement(fields[1])
+		transforms = append(transforms, t)
+		value = rest
+	}
+	return transforms, nil
+}
+
+// splitTransform returns the pattern and replacement of a substitution, and
+// the text after the final delimiter. A backslash before the delimiter
+// escapes it.
+func splitTransform(value string, delim byte) ([2]string, string, error) {
+	var fields [2]string
+	var field strings.Builder
+	var n int
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value) && value[i+1] == delim:
+			field.WriteByte(delim)
+			i++
+		case c == delim:
+			fields[n] = field.String()
+			field.Reset()
+			if n++; n == 2 {
+				return fields, value[i+1:], nil
+			}
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return fields, "", errors.New("missing delimiter")
+}
+
+// sedReplacement converts a sed style replacement into the template syntax
+// of the regexp package.
+func sedReplacement(replacement string) string {
+	var b strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '\\' && i+1 < len(replacement):
+			i++
+			if d := replacement[i]; d >= '0' && d <= '9' {
+				b.WriteString("${" + strconv.Itoa(int(d-'0')) + "}")
+			} else {
+				b.WriteByte(d)
+			}
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '$':
+			b.WriteString("$$")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
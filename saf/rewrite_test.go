@@ -0,0 +1,65 @@
+package saf
+
+import "testing"
+
+func TestParseTransforms(t *testing.T) {
+	cases := []struct {
+		expr, input, want string
+	}{
+		{"s/^out/release/", "out/out.txt", "release/out.txt"},
+		{"s/o/0/g", "foo/bob", "f00/b0b"},
+		{"s/o/0/", "foo/bob", "f0o/bob"},
+		{`s,(.*)\.txt$,\1.md,`, "a/b.txt", "a/b.md"},
+		{"s/B/[&]/i", "abc", "a[b]c"},
+		{`s/x/\//`, "axb", "a/b"},
+		{"s/a/$1/", "a", "$1"},
+		{"s/a/b/;s/b/c/", "a", "c"},
+	}
+
+	for _, c := range cases {
+		transforms, err := parseTransforms(c.expr)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		got := c.input
+		for _, tr := range transforms {
+			got = tr.apply(got)
+		}
+		if got != c.want {
+			t.Errorf("%s: GOT: %q; WANT: %q", c.expr, got, c.want)
+		}
+	}
+
+	for _, expr := range []string{"s/a", "y/a/b/", "s/a/b/q", "s/(/b/"} {
+		if _, err := parseTransforms(expr); err == nil {
+			t.Errorf("%s: GOT: nil; WANT: error", expr)
+		}
+	}
+}
+
+func TestRewriter(t *testing.T) {
+	rw := (&Rewriter{strip: 1, as: "release"}).start(nil)
+
+	if _, ok := rw.entry(MessageDirectoryDescend, "build"); ok {
+		t.Fatal("GOT: true; WANT: false")
+	}
+	if got, ok := rw.entry(MessageDirectoryDescend, "out"); !ok || got != "release" {
+		t.Fatalf("GOT: %q, %v; WANT: %q, true", got, ok, "release")
+	}
+	if got, ok := rw.entry(MessageRegularFile, "a.txt"); !ok || got != "a.txt" {
+		t.Fatalf("GOT: %q, %v; WANT: %q, true", got, ok, "a.txt")
+	}
+	if got := rw.parentPath(); got != "release" {
+		t.Fatalf("GOT: %q; WANT: %q", got, "release")
+	}
+	if ok, err := rw.ascend(); err != nil || !ok {
+		t.Fatalf("GOT: %v, %v; WANT: true, nil", ok, err)
+	}
+	if ok, err := rw.ascend(); err != nil || ok {
+		t.Fatalf("GOT: %v, %v; WANT: false, nil", ok, err)
+	}
+	if _, err := rw.ascend(); err == nil {
+		t.Fatal("GOT: nil; WANT: error")
+	}
+}
@@ -0,0 +1,217 @@
+package saf
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// Selection determines which entries of a stream are decoded. An entry is
+// selected when it is one of the paths, or is below one of them, when it or
+// one of its ancestors matches an include pattern, and when neither it nor any
+// of its ancestors matches an exclude pattern. Empty paths or include patterns
+// select every entry. Paths are relative to the root of the stream, and
+// patterns use the same syntax as those of a Filter.
+type Selection struct {
+	paths    []string
+	includes []string
+	excludes []string
+}
+
+// NewSelection returns the selection of the specified paths and patterns, or
+// nil when every entry is selected.
+func NewSelection(paths, include, exclude []string) *Selection {
+	s := &Selection{includes: include, excludes: exclude}
+	for _, p := range paths {
+		p = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+		s.paths = append(s.paths, p)
+	}
+	if len(s.paths) == 0 && len(s.includes) == 0 && len(s.excludes) == 0 {
+		return nil
+	}
+	return s
+}
+
+// matchPattern returns true when pattern matches pathname. Patterns without a
+// slash are matched against the final path component, while other patterns
+// are matched against the entire path, where "**" matches any number of
+// directories.
+func matchPattern(pattern, pathname string) bool {
+	if !strings.Contains(pattern, "/") {
+		pathname = path.Base(pathname)
+	}
+	return matchGlob(strings.TrimPrefix(pattern, "/"), pathname)
+}
+
+// matchGlob returns true when pattern matches every slash separated component
+// of name, where a "**" component matches zero or more components.
+func matchGlob(pattern, name string) bool {
+	return matchComponents(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchComponents(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchComponents(patterns[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(patterns[0], names[0]); !ok {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// matchAny returns true when any of the patterns match pathname or one of its
+// ancestors.
+func matchAny(patterns []string, pathname string) bool {
+	for p := pathname; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if matchPattern(pattern, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Selected returns true when the entry at pathname should be decoded.
+func (s *Selection) Selected(pathname string) bool {
+	if len(s.paths) > 0 {
+		var found bool
+		for _, p := range s.paths {
+			if pathname == p || strings.HasPrefix(pathname, p+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.includes) > 0 && !matchAny(s.includes, pathname) {
+		return false
+	}
+	return !matchAny(s.excludes, pathname)
+}
+
+// selectDir is a directory the stream has descended into. Directories that
+// are not selected are only created when one of their descendants is
+// selected, so their descend message is kept until then.
+type selectDir struct {
+	name         string
+	payload      []byte
+	materialized bool
+}
+
+// selectPath returns the path of the entry with the specified name in the
+// current directory.
+func (d *Decoder) selectPath(name string) string {
+	names := make([]string, 0, len(d.selectDirs)+1)
+	for _, sd := range d.selectDirs {
+		names = append(names, sd.name)
+	}
+	return path.Join(append(names, name)...)
+}
+
+// materialize invokes descend for each directory on the stack that has not
+// yet been created, so a selected entry may be extracted into it.
+func (d *Decoder) materialize(descend gobsp.MessageHandler) error {
+	for _, sd := range d.selectDirs {
+		if sd.materialized {
+			continue
+		}
+		if err := descend(bytes.NewReader(sd.payload)); err != nil {
+			return err
+		}
+		sd.materialized = true
+		sd.payload = nil
+	}
+	return nil
+}
+
+// selecting returns the handlers with each entry handler wrapped so it is
+// only invoked for entries accepted by selected. Entries that are not selected
+// are discarded without decompressing or verifying their contents.
+func (d *Decoder) selecting(selected func(string) bool, handlers map[gobsp.MessageType]gobsp.MessageHandler) map[gobsp.MessageType]gobsp.MessageHandler {
+	wrapped := make(map[gobsp.MessageType]gobsp.MessageHandler, len(handlers))
+	descend := handlers[MessageDirectoryDescend]
+
+	for messageType, handler := range handlers {
+		messageType, handler := messageType, handler
+
+		switch messageType {
+		case MessageDirectoryAscend:
+			wrapped[messageType] = func(r io.Reader) error {
+				if len(d.selectDirs) == 0 {
+					return errors.New("cannot ascend above stream root")
+				}
+				sd := d.selectDirs[len(d.selectDirs)-1]
+				d.selectDirs = d.selectDirs[:len(d.selectDirs)-1]
+				if !sd.materialized {
+					return nil
+				}
+				return handler(r)
+			}
+		default:
+			wrapped[messageType] = func(r io.Reader) error {
+				// Every entry message begins with the entry name.
+				var name gobsp.String
+				if err := name.UnmarshalBinaryFrom(r); err != nil {
+					return errors.Wrap(err, "cannot decode name")
+				}
+				prefix := new(bytes.Buffer)
+				_ = name.MarshalBinaryTo(prefix) // bytes.Buffer never returns error
+				r = io.MultiReader(prefix, r)
+
+				ok := selected(d.selectPath(string(name)))
+
+				if messageType == MessageDirectoryDescend {
+					sd := &selectDir{name: string(name)}
+					if !ok {
+						// Keep the message in case a descendant is selected.
+						payload, err := ioutil.ReadAll(r)
+						if err != nil {
+							return errors.Wrap(err, "cannot decode directory")
+						}
+						sd.payload = payload
+						d.selectDirs = append(d.selectDirs, sd)
+						return nil
+					}
+					if err := d.materialize(descend); err != nil {
+						return err
+					}
+					sd.materialized = true
+					d.selectDirs = append(d.selectDirs, sd)
+					return handler(r)
+				}
+
+				if !ok {
+					d.log.Debugf("%s skip\n", d.selectPath(string(name)))
+					d.skipped(d.selectPath(string(name)), entryModeTypes[messageType], 0)
+					return nil
+				}
+				if err := d.materialize(descend); err != nil {
+					return err
+				}
+				return handler(r)
+			}
+		}
+	}
+
+	return wrapped
+}
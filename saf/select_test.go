@@ -0,0 +1,24 @@
+package saf
+
+import "testing"
+
+func TestSelectionSelected(t *testing.T) {
+	s := NewSelection([]string{"/foo/"}, []string{"*.txt", "foo/keep"}, []string{"skip"})
+
+	cases := map[string]bool{
+		"foo/a.txt":        true,
+		"foo/keep/b.go":    true,
+		"foo/b.go":         false,
+		"foo/skip/a.txt":   false,
+		"foobar/a.txt":     false,
+		"bar/a.txt":        false,
+		"foo/keep/skip":    false,
+		"foo/dir/deep.txt": true,
+	}
+
+	for pathname, want := range cases {
+		if got := s.Selected(pathname); got != want {
+			t.Errorf("%s: GOT: %v; WANT: %v", pathname, got, want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package saf
+
+import (
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// The sender signs the payload of the trailer message, which includes the
+// SHA-256 digest of every preceding message, so a valid signature proves every
+// message came from the holder of the private key. The signature is either
+// embedded in the stream as a signature message immediately following the
+// trailer, or detached and kept separately from the stream.
+
+// composeSignature signs the trailer payload, and either sends the signature
+// or keeps it to be returned by Signature.
+func (e *Encoder) composeSignature(trailer []byte) error {
+	signature := ed25519.Sign(e.opts.SignKey, trailer)
+	if e.opts.DetachSignature {
+		e.signature = signature
+		return nil
+	}
+	return e.composer.Compose(MessageSignature, signature)
+}
+
+var errSignatureNotReceived = errors.New("stream signature not received")
+
+func (d *Decoder) decodeSignature(r io.Reader) error {
+	d.log.Debugf("decode signature\n")
+	signature, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "cannot decode signature")
+	}
+	d.verifySignature(signature)
+	return nil
+}
+
+// verifySignature records whether signature is a valid signature over the
+// received trailer.
+func (d *Decoder) verifySignature(signature []byte) {
+	switch {
+	case d.opts.VerifyKey == nil:
+		d.signatureErr = nil // not asked to verify
+	case d.trailer == nil:
+		d.signatureErr = errors.New("stream signature received before trailer")
+	case !ed25519.Verify(d.opts.VerifyKey, d.trailer, signature):
+		d.signatureErr = errors.New("stream signature is not valid")
+	default:
+		d.signatureErr = nil
+	}
+}
+
+// verified returns nil when the stream trailer matched, and when asked to
+// verify the stream, its signature is valid.
+func (d *Decoder) verified() error {
+	if d.trailerErr != nil {
+		return d.trailerErr
+	}
+	if d.opts.VerifyKey == nil {
+		return nil
+	}
+	if d.opts.Signature != nil {
+		d.verifySignature(d.opts.Signature)
+	}
+	return d.signatureErr
+}
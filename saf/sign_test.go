@@ -0,0 +1,30 @@
+package saf
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Decoder{opts: DecoderOptions{VerifyKey: public}, trailer: []byte("trailer payload")}
+
+	d.verifySignature(ed25519.Sign(private, d.trailer))
+	if d.signatureErr != nil {
+		t.Errorf("GOT: %v; WANT: nil", d.signatureErr)
+	}
+
+	d.verifySignature(ed25519.Sign(private, []byte("other payload")))
+	if d.signatureErr == nil {
+		t.Errorf("GOT: nil; WANT: error")
+	}
+
+	d.trailer = nil
+	d.verifySignature(ed25519.Sign(private, []byte("trailer payload")))
+	if d.signatureErr == nil {
+		t.Errorf("GOT: nil; WANT: error")
+	}
+}
@@ -0,0 +1,224 @@
+package saf
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sink is the destination of the entries created by an Extractor. Each
+// pathname is the slash separated path of the entry relative to the root of
+// the stream, and the directory containing it has already been created by
+// Mkdir. An entry of a different type with the same pathname is replaced.
+type Sink interface {
+	// Mkdir creates the directory unless it already exists.
+	Mkdir(pathname string, mode fs.FileMode) error
+
+	// CreateFile creates or truncates the regular file, and writes contents
+	// to it.
+	CreateFile(pathname string, contents io.Reader) error
+
+	// Symlink creates a symlink whose referent is linkname.
+	Symlink(linkname, pathname string) error
+
+	// Mkfifo creates a FIFO.
+	Mkfifo(pathname string, mode fs.FileMode) error
+
+	// SetMetadata sets the permissions and modification time of a regular
+	// file or FIFO after it is created.
+	SetMetadata(pathname string, mode fs.FileMode, mtime time.Time) error
+
+	// Ascend is invoked after every entry in the directory has been created,
+	// with the modification time the directory should have.
+	Ascend(pathname string, mtime time.Time) error
+}
+
+// FileStager is implemented by a Sink that can write the contents of a
+// regular file without them being visible at pathname until they are
+// committed. A deferred Extractor holds the contents of regular files in
+// temporary files in the default temporary directory for a Sink that does
+// not implement it.
+type FileStager interface {
+	// StageFile writes contents, and returns a function that commits them
+	// to pathname, and a function that discards them. Discard is always
+	// invoked, even after commit.
+	StageFile(pathname string, contents io.Reader) (commit, discard func() error, err error)
+}
+
+// DirSink is a Sink that creates entries in the local file system, below the
+// named directory. The owner of entries is not restored.
+type DirSink string
+
+func (root DirSink) path(pathname string) string {
+	return filepath.Join(string(root), filepath.FromSlash(pathname))
+}
+
+// Mkdir creates the directory unless it already exists, replacing any other
+// type of entry with the same name. The permissions of an existing directory
+// are not changed.
+func (root DirSink) Mkdir(pathname string, mode fs.FileMode) error {
+	pathname = root.path(pathname)
+	fi, err := os.Lstat(pathname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(os.Mkdir(pathname, mode.Perm()))
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	if err = os.Remove(pathname); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Mkdir(pathname, mode.Perm()))
+}
+
+// CreateFile writes contents to the regular file, replacing an entry of
+// another type. An existing regular file is written over, keeping its owner,
+// extended attributes, and ACLs, unless it has other hard links, in which
+// case it is removed so the other links keep their contents.
+func (root DirSink) CreateFile(pathname string, contents io.Reader) error {
+	pathname = root.path(pathname)
+	fi, err := os.Lstat(pathname)
+	if err == nil && (!fi.Mode().IsRegular() || links(fi) > 1) {
+		err = os.RemoveAll(pathname)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return writeFile(pathname, contents)
+}
+
+// writeFile writes contents to the file system entry at pathname, which is
+// either a regular file or does not exist.
+func writeFile(pathname string, contents io.Reader) error {
+	//
+	// ??? Consider adding optimizations to elide overwrite based on mtime,
+	// hash, mode, and size
+	//
+
+	//
+	// TODO: deal with situation when requested permissions prevent
+	// modifications
+	//
+
+	fh, err := os.OpenFile(pathname, os.O_RDWR|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// When contents are read from another file, as they are by a Copier,
+	// io.Copy uses copy_file_range on Linux, and falls back to reading and
+	// writing them where it is not supported.
+	n, err := io.Copy(fh, contents)
+	if err != nil {
+		_ = fh.Close() // ignore secondary error
+		return errors.WithStack(err)
+	}
+
+	// Truncate file after size bytes to handle smaller source than destination.
+	if err = fh.Truncate(n); err != nil {
+		_ = fh.Close() // ignore secondary error
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(fh.Close())
+}
+
+// StageFile writes contents to a temporary file in the directory of
+// pathname, which commit renames to pathname.
+func (root DirSink) StageFile(pathname string, contents io.Reader) (func() error, func() error, error) {
+	pathname = root.path(pathname)
+	fh, err := ioutil.TempFile(filepath.Dir(pathname), ".tsync-staged-")
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	staged := fh.Name()
+	discard := func() error {
+		// Staged files already committed have been renamed.
+		if err := os.Remove(staged); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err = fh.Close(); err == nil {
+		err = writeFile(staged, contents)
+	}
+	if err != nil {
+		_ = discard() // ignore secondary error
+		return nil, nil, errors.WithStack(err)
+	}
+	commit := func() error {
+		if err := removeUnlessType(pathname, os.FileMode.IsRegular); err != nil {
+			return err
+		}
+		return errors.WithStack(os.Rename(staged, pathname))
+	}
+	return commit, discard, nil
+}
+
+// Symlink creates the symlink.
+func (root DirSink) Symlink(linkname, pathname string) error {
+	pathname = root.path(pathname)
+	if err := removeUnlessType(pathname, isSymlink); err != nil {
+		return err
+	}
+	return errors.WithStack(os.Symlink(linkname, pathname))
+}
+
+// Mkfifo creates the FIFO.
+func (root DirSink) Mkfifo(pathname string, mode fs.FileMode) error {
+	pathname = root.path(pathname)
+	if err := removeUnlessType(pathname, isFIFO); err != nil {
+		return err
+	}
+	return makeFIFO(pathname, uint32(mode.Perm()))
+}
+
+// mksocket creates the socket. Sockets cannot be created by other sinks.
+func (root DirSink) mksocket(pathname string, mode fs.FileMode, mtime time.Time) error {
+	pathname = root.path(pathname)
+	if err := removeUnlessType(pathname, isSocket); err != nil {
+		return err
+	}
+	return makeSocket(pathname, uint32(mode), mtime)
+}
+
+// SetMetadata sets the permissions and modification time.
+func (root DirSink) SetMetadata(pathname string, mode fs.FileMode, mtime time.Time) error {
+	pathname = root.path(pathname)
+	if err := os.Chmod(pathname, mode.Perm()); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrap(os.Chtimes(pathname, mtime, mtime), "cannot chtimes")
+}
+
+// Ascend sets the modification time of the directory.
+func (root DirSink) Ascend(pathname string, mtime time.Time) error {
+	return errors.WithStack(os.Chtimes(root.path(pathname), mtime, mtime))
+}
+
+// removeUnlessType removes the file system entry at pathname when it exists
+// but its mode is not the expected type.
+func removeUnlessType(pathname string, isType func(os.FileMode) bool) error {
+	fi, err := os.Lstat(pathname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+	if !isType(fi.Mode()) {
+		return errors.WithStack(os.RemoveAll(pathname))
+	}
+	return nil
+}
+
+func isFIFO(mode os.FileMode) bool    { return mode&os.ModeNamedPipe != 0 }
+func isSocket(mode os.FileMode) bool  { return mode&os.ModeSocket != 0 }
+func isSymlink(mode os.FileMode) bool { return mode&os.ModeSymlink != 0 }
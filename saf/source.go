@@ -0,0 +1,163 @@
+package saf
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Walker produces the entries of a tree that is not in the local file
+// system, such as a container image layer or another archive, for
+// AddWalker.
+type Walker interface {
+	// Walk invokes fn with each entry of the tree, where the path of the
+	// entry is slash separated and relative to the root of the stream. The
+	// stream is smallest when the entries in each directory immediately
+	// follow the directory. The contents of a regular file must provide
+	// entry.Size bytes, and are only read before fn returns. When fn returns
+	// an error, the stream cannot be completed, and Walk must return it.
+	Walk(fn func(entry *Entry, contents io.Reader) error) error
+}
+
+// AddWalker sends each entry produced by w, as though it was added by
+// AddEntry. Entries that cannot be sent are reported to the Logger as
+// warnings, and AddWalker only returns an error when w does, or when the
+// stream cannot be written.
+func (e *Encoder) AddWalker(w Walker) error {
+	return w.Walk(func(entry *Entry, contents io.Reader) error {
+		start := time.Now()
+		if err := e.AddEntry(entry, contents); err != nil {
+			if e.err != nil {
+				return e.err // stream cannot be completed
+			}
+			e.failed(entry.Path, entry.Mode, time.Since(start), err)
+			e.log.Warningf("%s: %s\n", entry.Path, err)
+		}
+		return nil
+	})
+}
+
+// AddFS sends the entry named root in fsys as a top-level entry of the
+// stream, and when it is a directory, every entry below it that is not
+// filtered out, in lexical order. When root is ".", the entries in the root
+// of fsys are sent as top-level entries instead. Symlinks are only sent when
+// fsys has a ReadLink method like that of FS, and are never dereferenced.
+// The owner of each entry is only known when fsys is an FS, or is in the
+// local file system, such as one returned by os.DirFS.
+func (e *Encoder) AddFS(fsys fs.FS, root string) error {
+	if !fs.ValidPath(root) {
+		return &fs.PathError{Op: "walk", Path: root, Err: fs.ErrInvalid}
+	}
+	return e.AddWalker(&fsWalker{e: e, fsys: fsys, root: root})
+}
+
+// fsWalker walks an fs.FS for AddFS, applying the filters of the Encoder.
+type fsWalker struct {
+	e    *Encoder
+	fsys fs.FS
+	root string
+}
+
+// streamPath returns the path in the stream of the named entry of fsys.
+func (w *fsWalker) streamPath(name string) string {
+	if w.root == "." {
+		return name
+	}
+	return path.Base(w.root) + strings.TrimPrefix(name, w.root)
+}
+
+func (w *fsWalker) Walk(fn func(entry *Entry, contents io.Reader) error) error {
+	return fs.WalkDir(w.fsys, w.root, func(name string, de fs.DirEntry, err error) error {
+		start := time.Now()
+		if err != nil {
+			if name == w.root {
+				return err
+			}
+			mode := fs.ModeIrregular
+			if de != nil {
+				mode = de.Type()
+			}
+			w.e.failed(w.streamPath(name), mode, 0, err)
+			w.e.log.Warningf("%s: %s\n", name, err)
+			return nil
+		}
+		if name == "." {
+			return nil // root of fsys is not sent
+		}
+
+		pathname := w.streamPath(name)
+		if w.e.hasFilters() && w.e.excluded(pathname, de.IsDir()) {
+			w.e.log.Debugf("%s excluded\n", name)
+			w.e.skipped(pathname, de.Type())
+			if de.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if err = w.walkEntry(name, pathname, de, fn); err != nil {
+			if w.e.err != nil {
+				return err // stream cannot be completed
+			}
+			if name == w.root {
+				return err
+			}
+			w.e.failed(pathname, de.Type(), time.Since(start), err)
+			w.e.log.Warningf("%s: %s\n", name, err)
+			if de.IsDir() {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+}
+
+// walkEntry invokes fn with the named entry of fsys.
+func (w *fsWalker) walkEntry(name, pathname string, de fs.DirEntry, fn func(*Entry, io.Reader) error) error {
+	w.e.log.Debugf("%s encode %s\n", name, de.Type())
+
+	fi, err := de.Info()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	uid, gid := owner(fi)
+	if o, ok := fi.(interface{ owner() (uint32, uint32) }); ok {
+		uid, gid = o.owner()
+	}
+	entry := &Entry{
+		Path:    pathname,
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+		UID:     uid,
+		GID:     gid,
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		fh, err := w.fsys.Open(name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		entry.Size = fi.Size()
+		err = fn(entry, fh)
+		if err2 := fh.Close(); err == nil {
+			err = err2
+		}
+		return err
+	case fi.Mode()&fs.ModeSymlink != 0:
+		rl, ok := w.fsys.(interface {
+			ReadLink(name string) (string, error)
+		})
+		if !ok {
+			return errors.New("cannot encode symlink: file system cannot read symlinks")
+		}
+		if entry.Linkname, err = rl.ReadLink(name); err != nil {
+			return errors.Wrap(err, "cannot encode symlink")
+		}
+	}
+	return fn(entry, nil)
+}
@@ -0,0 +1,152 @@
+package saf
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// walkerFunc adapts a function to the Walker interface.
+type walkerFunc func(fn func(*Entry, io.Reader) error) error
+
+func (f walkerFunc) Walk(fn func(*Entry, io.Reader) error) error { return f(fn) }
+
+func TestAddFS(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	fsys := fstest.MapFS{
+		"top/a/b":        {Data: []byte("top/a/b"), Mode: 0644, ModTime: mtime},
+		"top/a/skip.tmp": {Data: []byte("skip"), Mode: 0644, ModTime: mtime},
+		"top/c":          {Data: []byte("top/c"), Mode: 0600, ModTime: mtime},
+		"top/p":          {Mode: fs.ModeNamedPipe | 0644, ModTime: mtime},
+		"other":          {Data: []byte("other"), Mode: 0644, ModTime: mtime},
+	}
+
+	encode := func(t *testing.T, add func(e *Encoder) error) string {
+		t.Helper()
+		buf := new(bytes.Buffer)
+		e, err := NewEncoder(buf, EncoderOptions{Filter: NewFilter(nil, []string{"*.tmp"})})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = add(e); err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeEntries(t, buf, DecoderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		got := encode(t, func(e *Encoder) error { return e.AddFS(fsys, "top") })
+		if want := "top/,top/a/,top/a/b,..,top/c,top/p,.."; got != want {
+			t.Errorf("GOT: %s; WANT: %s", got, want)
+		}
+	})
+
+	t.Run("root", func(t *testing.T) {
+		got := encode(t, func(e *Encoder) error { return e.AddFS(fsys, ".") })
+		if want := "other,top/,top/a/,top/a/b,..,top/c,top/p,.."; got != want {
+			t.Errorf("GOT: %s; WANT: %s", got, want)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		e, err := NewEncoder(io.Discard, EncoderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.AddFS(fsys, "missing"); err == nil {
+			t.Errorf("GOT: nil; WANT: error")
+		}
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		archive, err := NewFS(bytes.NewReader(testArchive(t)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		e, err := NewEncoder(buf, EncoderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.AddFS(archive, "."); err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		ms := NewMemorySink()
+		extractEntries(t, buf.Bytes(), ms, false, true)
+		if got, want := sinkNames(ms), "dir,dir/compressed.txt,dir/link,dir/plain.txt,fifo"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := ms.Entries["dir/link"].Linkname, "plain.txt"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+		if got, want := string(ms.Entries["dir/plain.txt"].Contents), "plain"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	t.Run("walker", func(t *testing.T) {
+		got := encode(t, func(e *Encoder) error {
+			return e.AddWalker(walkerFunc(func(fn func(*Entry, io.Reader) error) error {
+				for _, p := range []string{"x/y", "x/z"} {
+					entry := &Entry{Path: p, Mode: 0644, ModTime: mtime, Size: int64(len(p))}
+					if err := fn(entry, strings.NewReader(p)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		})
+		if want := "x/,x/y,x/z,.."; got != want {
+			t.Errorf("GOT: %s; WANT: %s", got, want)
+		}
+	})
+}
+
+func TestAddEntrySize(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	buf := new(bytes.Buffer)
+	e, err := NewEncoder(buf, EncoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddEntry(&Entry{Path: "negative", Mode: 0644, ModTime: mtime, Size: -1}, strings.NewReader("")); err == nil {
+		t.Errorf("GOT: nil; WANT: error")
+	}
+	// The size is not trusted when allocating memory for the contents.
+	if err = e.AddEntry(&Entry{Path: "huge", Mode: 0644, ModTime: mtime, Size: 1 << 62}, strings.NewReader("short")); err == nil {
+		t.Errorf("GOT: nil; WANT: error")
+	}
+	if err = e.AddEntry(&Entry{Path: "short", Mode: 0644, ModTime: mtime, Size: 5}, strings.NewReader("short")); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddEntry(&Entry{Path: "empty", Mode: 0644, ModTime: mtime}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := NewMemorySink()
+	extractEntries(t, buf.Bytes(), ms, false, true)
+	if got, want := sinkNames(ms), "empty,short"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got := ms.Entries["empty"].Contents; len(got) != 0 {
+		t.Errorf("GOT: %q; WANT: empty", got)
+	}
+}
@@ -0,0 +1,35 @@
+package saf
+
+import "io/fs"
+
+// Stats counts what an Encoder or Decoder has done so far. Entries are
+// counted by type when they are sent by an Encoder, or visited without error
+// by a Decoder.
+type Stats struct {
+	Directories int64
+	Files       int64
+	Symlinks    int64
+	FIFOs       int64
+	Sockets     int64
+	Bytes       int64 // size of the contents of regular files
+
+	Skipped        int64 // entries excluded by a filter, or not selected
+	Failed         int64 // entries that could not be sent or visited
+	HashMismatches int64 // regular files whose contents do not match their hash
+}
+
+func (s *Stats) count(entry *Entry) {
+	switch mode := entry.Mode; {
+	case mode.IsDir():
+		s.Directories++
+	case mode.IsRegular():
+		s.Files++
+		s.Bytes += entry.Size
+	case mode&fs.ModeSymlink != 0:
+		s.Symlinks++
+	case mode&fs.ModeNamedPipe != 0:
+		s.FIFOs++
+	case mode&fs.ModeSocket != 0:
+		s.Sockets++
+	}
+}
@@ -0,0 +1,45 @@
+package saf
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	stream := encodeEntries(t, EncoderOptions{Index: true}, "a/p|", "a/b/q", "c/r")
+
+	decodeStats := func(t *testing.T, r io.Reader, opts DecoderOptions) Stats {
+		t.Helper()
+		d, err := NewDecoder(r, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = d.Decode(new(recorder)) // damaged streams are expected to fail
+		return d.Stats()
+	}
+
+	selected := func(pathname string) bool { return pathname == "a/b/q" }
+	want := Stats{Directories: 2, Files: 1, Bytes: 5, Skipped: 2}
+
+	t.Run("streamed", func(t *testing.T) {
+		if got := decodeStats(t, bytes.NewBuffer(stream), DecoderOptions{Select: selected}); got != want {
+			t.Errorf("GOT: %+v; WANT: %+v", got, want)
+		}
+	})
+
+	t.Run("indexed", func(t *testing.T) {
+		if got := decodeStats(t, bytes.NewReader(stream), DecoderOptions{Select: selected}); got != want {
+			t.Errorf("GOT: %+v; WANT: %+v", got, want)
+		}
+	})
+
+	t.Run("hash mismatch", func(t *testing.T) {
+		damaged := append([]byte(nil), stream...)
+		damaged[bytes.Index(damaged, []byte("a/b/q"))] ^= 0xff
+		got := decodeStats(t, bytes.NewBuffer(damaged), DecoderOptions{})
+		if got.HashMismatches != 1 || got.Failed != 1 || got.Files != 1 {
+			t.Errorf("GOT: %+v; WANT: 1 hash mismatch, 1 failed, 1 file", got)
+		}
+	})
+}
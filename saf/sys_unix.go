@@ -0,0 +1,54 @@
+// +build darwin dragonfly freebsd netbsd openbsd linux
+
+package saf
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func makeFIFO(targetBase string, mode uint32) error {
+	return errors.Wrap(unix.Mkfifo(targetBase, mode), "cannot mkfifo")
+}
+
+// makeSocket returns an error because sockets cannot yet be created.
+func makeSocket(targetBase string, mode uint32, mtime time.Time) error {
+	return errors.Errorf("%s decode socket not implemented", targetBase)
+}
+
+// owner returns the numeric user and group IDs of the owner of the file system
+// entry.
+func owner(fi os.FileInfo) (uint32, uint32) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid
+	}
+	return 0, 0
+}
+
+// device returns the ID of the device holding the file system entry.
+func device(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
+
+// links returns the number of hard links to the file system entry.
+func links(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// inode returns the inode number of the file system entry.
+func inode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
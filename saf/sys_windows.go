@@ -0,0 +1,46 @@
+package saf
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func makeFIFO(targetBase string, mode uint32) error {
+	return errors.Errorf("%s Windows does not support FIFOs in the file system", targetBase)
+}
+
+func makeSocket(targetBase string, mode uint32, mtime time.Time) error {
+	return errors.Errorf("%s decode socket not yet implemented on Windows", targetBase)
+}
+
+// owner returns zero for both user and group IDs because Windows does not
+// have numeric owners.
+func owner(fi os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+// device returns zero because every file system entry is treated as being on
+// the same device.
+func device(fi os.FileInfo) uint64 {
+	return 0
+}
+
+// links returns one because link counts are not available from os.FileInfo
+// on Windows.
+func links(fi os.FileInfo) uint64 {
+	return 1
+}
+
+// inode returns zero because file identity is not available from
+// os.FileInfo on Windows.
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
+
+// fsType returns an empty string because file system types are not yet
+// supported on Windows.
+func fsType(pathname string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,234 @@
+package saf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/karrick/gobsp"
+	"github.com/pkg/errors"
+)
+
+// streamTotals accumulates the number of entries of each type that have been
+// sent or received, the number of message payload bytes, and a running SHA-256
+// digest of every message preceding the trailer. The sender emits its totals
+// in the trailer message, and the recipient compares the trailer with its own
+// totals to detect truncated or otherwise damaged streams. The digest is
+// cryptographic because signing the trailer must cover every message.
+type streamTotals struct {
+	directories uint64
+	files       uint64
+	symlinks    uint64
+	fifos       uint64
+	sockets     uint64
+	devices     uint64
+	bytes       uint64
+	digest      hash.Hash
+}
+
+func newStreamTotals() *streamTotals {
+	return &streamTotals{digest: sha256.New()}
+}
+
+// count increments the entry count corresponding to messageType.
+func (st *streamTotals) count(messageType gobsp.MessageType) {
+	switch messageType {
+	case MessageRegularFile:
+		st.files++
+	case MessageDirectoryDescend:
+		st.directories++
+	case MessageSymlink:
+		st.symlinks++
+	case MessageFIFO:
+		st.fifos++
+	case MessageSocket:
+		st.sockets++
+	case MessageDevice:
+		st.devices++
+	}
+}
+
+// Write includes p in the payload byte count and the running digest.
+func (st *streamTotals) Write(p []byte) (int, error) {
+	st.bytes += uint64(len(p))
+	return st.digest.Write(p)
+}
+
+// MarshalBinaryTo writes the totals to iow in the trailer message format.
+func (st *streamTotals) MarshalBinaryTo(iow io.Writer) error {
+	for _, v := range []uint64{st.directories, st.files, st.symlinks, st.fifos, st.sockets, st.devices, st.bytes} {
+		if err := gobsp.Uint64(v).MarshalBinaryTo(iow); err != nil {
+			return err
+		}
+	}
+	_, err := iow.Write(st.digest.Sum(nil))
+	return err
+}
+
+// compare returns an error that describes each difference between the totals
+// st and the totals received in the trailer message read from r.
+func (st *streamTotals) compare(r io.Reader) error {
+	var mismatches []string
+
+	fields := []struct {
+		name string
+		have uint64
+	}{
+		{"directories", st.directories},
+		{"files", st.files},
+		{"symlinks", st.symlinks},
+		{"FIFOs", st.fifos},
+		{"sockets", st.sockets},
+		{"devices", st.devices},
+		{"bytes", st.bytes},
+	}
+
+	for _, field := range fields {
+		var want gobsp.Uint64
+		if err := want.UnmarshalBinaryFrom(r); err != nil {
+			return errors.Wrapf(err, "cannot decode trailer %s", field.name)
+		}
+		if field.have != uint64(want) {
+			mismatches = append(mismatches, field.name+": "+gobsp.Uint64(field.have).String()+" != "+want.String())
+		}
+	}
+
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, digest); err != nil {
+		return errors.Wrap(err, "cannot decode trailer digest")
+	}
+	if have := st.digest.Sum(nil); !bytes.Equal(have, digest) {
+		mismatches = append(mismatches, "digest mismatch")
+	}
+
+	if len(mismatches) > 0 {
+		buf := bytes.NewBufferString("trailer does not match stream:")
+		for _, m := range mismatches {
+			buf.WriteString(" ")
+			buf.WriteString(m)
+			buf.WriteString(";")
+		}
+		buf.Truncate(buf.Len() - 1)
+		return errors.New(buf.String())
+	}
+	return nil
+}
+
+// compose sends the message, and when successful, includes the message in the
+// running totals that will be sent in the trailer, and when indexing, in the
+// index. Once a message cannot be sent, the stream cannot be completed, so
+// every later message fails with the same error.
+func (e *Encoder) compose(messageType gobsp.MessageType, message []byte) error {
+	_, err := e.composeRewritten(messageType, message)
+	return err
+}
+
+// composeRewritten is like compose, but also returns false when the rewriter
+// strips the message rather than sending it.
+func (e *Encoder) composeRewritten(messageType gobsp.MessageType, message []byte) (bool, error) {
+	if e.err != nil {
+		return false, e.err
+	}
+	if e.rw != nil {
+		var ok bool
+		var err error
+		if message, ok, err = e.rw.rewriteMessage(messageType, message); err != nil || !ok {
+			return false, err
+		}
+	}
+	if err := e.composer.Compose(messageType, message); err != nil {
+		e.err = errors.Wrap(err, "cannot write stream")
+		return false, e.err
+	}
+	offset := e.offset
+	e.offset += messageLength(messageType, len(message))
+	if e.indexing {
+		if err := e.indexMessage(offset, messageType, message); err != nil {
+			return false, err
+		}
+	}
+	e.totals.count(messageType)
+	_ = gobsp.UVWI(messageType).MarshalBinaryTo(e.totals.digest) // hash never returns error
+	_, _ = e.totals.Write(message)
+	return true, nil
+}
+
+// composeTrailer sends the trailer, and returns a copy of its payload so the
+// trailer may be signed.
+func (e *Encoder) composeTrailer() ([]byte, error) {
+	e.messageScratch.Reset()
+	if err := e.totals.MarshalBinaryTo(e.messageScratch); err != nil {
+		return nil, errors.Wrap(err, "cannot encode trailer")
+	}
+	trailer := append([]byte(nil), e.messageScratch.Bytes()...)
+	return trailer, e.composer.Compose(MessageTrailer, trailer)
+}
+
+var errTrailerNotReceived = errors.New("stream truncated: trailer not received")
+
+// digesting returns a message handler that includes the message in the
+// running totals, then invokes handler.
+func (d *Decoder) digesting(messageType gobsp.MessageType, handler gobsp.MessageHandler) gobsp.MessageHandler {
+	return func(r io.Reader) error {
+		if d.trailerErr == nil {
+			// Any message after the trailer invalidates the stream.
+			d.trailerErr = errors.New("stream has messages after trailer")
+		}
+		d.totals.count(messageType)
+		_ = gobsp.UVWI(messageType).MarshalBinaryTo(d.totals.digest) // hash never returns error
+		tr := io.TeeReader(r, d.totals)
+		err := handler(tr)
+		// Handler might not have consumed the entire message, but the digest
+		// must include every byte.
+		if err2 := gobsp.DiscardAll(tr); err == nil {
+			err = err2
+		}
+		return err
+	}
+}
+
+// decodeTrailer records whether the trailer matches the messages received
+// before it. It always returns nil, because Decode reports the result after
+// the stream ends.
+func (d *Decoder) decodeTrailer(r io.Reader) error {
+	d.log.Debugf("decode trailer\n")
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		d.trailerErr = errors.Wrap(err, "cannot decode trailer")
+		return nil
+	}
+	d.trailer = buf
+	d.trailerErr = d.totals.compare(bytes.NewReader(buf))
+	return nil
+}
+
+// verifyArchive reads every message of the archive file before its trailer
+// without decoding them, and compares them with the trailer, so an archive
+// whose selected entries were read from its index is still verified.
+func (d *Decoder) verifyArchive() error {
+	var offset int64
+	for {
+		mt, payload, length, err := MessageAt(d.ra, offset)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return errTrailerNotReceived
+			}
+			return errors.Wrap(err, "cannot verify archive")
+		}
+		if mt == MessageTrailer {
+			_ = d.decodeTrailer(payload) // records the result in trailerErr
+			return d.trailerErr
+		}
+		d.totals.count(mt)
+		_ = gobsp.UVWI(mt).MarshalBinaryTo(d.totals.digest) // hash never returns error
+		if _, err = io.Copy(d.totals, payload); err != nil {
+			return errors.Wrap(err, "cannot verify archive")
+		}
+		if n, _ := payload.Seek(0, io.SeekCurrent); n < payload.Size() {
+			return errors.Wrap(io.ErrUnexpectedEOF, "cannot verify archive")
+		}
+		offset += length
+	}
+}
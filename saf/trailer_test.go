@@ -0,0 +1,57 @@
+package saf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreamTotals(t *testing.T) {
+	sent := newStreamTotals()
+	sent.count(MessageDirectoryDescend)
+	sent.count(MessageRegularFile)
+	sent.bytes = 13
+	_, _ = sent.digest.Write([]byte("some message"))
+
+	trailer := new(bytes.Buffer)
+	if err := sent.MarshalBinaryTo(trailer); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("match", func(t *testing.T) {
+		received := newStreamTotals()
+		received.count(MessageDirectoryDescend)
+		received.count(MessageRegularFile)
+		received.bytes = 13
+		_, _ = received.digest.Write([]byte("some message"))
+
+		if err := received.compare(bytes.NewReader(trailer.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		received := newStreamTotals()
+		received.count(MessageDirectoryDescend)
+		received.bytes = 13
+		_, _ = received.digest.Write([]byte("some message"))
+
+		err := received.compare(bytes.NewReader(trailer.Bytes()))
+		if err == nil {
+			t.Fatal("GOT: nil; WANT: error")
+		}
+		if got, want := err.Error(), "files: 0 != 1"; !strings.Contains(got, want) {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := err.Error(), "digest"; strings.Contains(got, want) {
+			t.Errorf("GOT: %v; WANT: no %v", got, want)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		received := newStreamTotals()
+		if err := received.compare(bytes.NewReader(trailer.Bytes()[:trailer.Len()-1])); err == nil {
+			t.Fatal("GOT: nil; WANT: error")
+		}
+	})
+}
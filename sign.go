@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readSignKey returns the Ed25519 private key stored in PKCS #8 PEM format in
+// the specified file, as created by `openssl genpkey -algorithm ed25519`.
+func readSignKey(pathname string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(pathname)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse signing key")
+	}
+	pk, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("cannot use signing key: not Ed25519: %T", key)
+	}
+	return pk, nil
+}
+
+// readVerifyKey returns the Ed25519 public key stored in PKIX PEM format in
+// the specified file, as created by `openssl pkey -pubout`.
+func readVerifyKey(pathname string) (ed25519.PublicKey, error) {
+	block, err := readPEM(pathname)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse verification key")
+	}
+	pk, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("cannot use verification key: not Ed25519: %T", key)
+	}
+	return pk, nil
+}
+
+func readPEM(pathname string) (*pem.Block, error) {
+	buf, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.Errorf("cannot find PEM block in %q", pathname)
+	}
+	return block, nil
+}
+
+// readSignatureFile returns the detached signature stored base64 encoded in
+// the specified file.
+func readSignatureFile(pathname string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read signature file")
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode signature file")
+	}
+	return signature, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writePEM writes the DER bytes as a PEM block of the specified type to a
+// file, and returns the name of the file.
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	pathname := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(pathname, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pathname
+}
+
+func TestReadKeys(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKeyFile := writePEM(t, "PRIVATE KEY", privateDER)
+	verifyKeyFile := writePEM(t, "PUBLIC KEY", publicDER)
+
+	t.Run("sign key", func(t *testing.T) {
+		got, err := readSignKey(signKeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(private) {
+			t.Errorf("GOT: %x; WANT: %x", got, private)
+		}
+		if _, err = readSignKey(verifyKeyFile); err == nil {
+			t.Errorf("GOT: nil; WANT: error")
+		}
+	})
+
+	t.Run("verify key", func(t *testing.T) {
+		got, err := readVerifyKey(verifyKeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(public) {
+			t.Errorf("GOT: %x; WANT: %x", got, public)
+		}
+		if _, err = readVerifyKey(signKeyFile); err == nil {
+			t.Errorf("GOT: nil; WANT: error")
+		}
+	})
+
+	t.Run("not PEM", func(t *testing.T) {
+		pathname := filepath.Join(t.TempDir(), "key.pem")
+		if err := ioutil.WriteFile(pathname, []byte("not a key\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSignKey(pathname); err == nil {
+			t.Errorf("GOT: nil; WANT: error")
+		}
+		if _, err := readVerifyKey(pathname); err == nil {
+			t.Errorf("GOT: nil; WANT: error")
+		}
+	})
+}
+
+func TestReadSignatureFile(t *testing.T) {
+	signature := bytes.Repeat([]byte{0xa5}, ed25519.SignatureSize)
+	pathname := filepath.Join(t.TempDir(), "stream.sig")
+
+	if err := ioutil.WriteFile(pathname, []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readSignatureFile(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, signature) {
+		t.Errorf("GOT: %x; WANT: %x", got, signature)
+	}
+
+	if err = ioutil.WriteFile(pathname, []byte("not base64!\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readSignatureFile(pathname); err == nil {
+		t.Errorf("GOT: nil; WANT: error")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/karrick/tsync/saf"
+	"github.com/pkg/errors"
+)
+
+// activeStats accumulates the statistics of the current run, if any.
+var activeStats *runStats
+
+// warnings counts the warnings printed, which are included in the
+// statistics.
+var warnings int64
+
+// runStats describes what a create or extract did. Bytes read and written
+// are file contents when read from or written to the file system, and the
+// stream otherwise.
+type runStats struct {
+	Command        string    `json:"command"`
+	Directories    int64     `json:"directories"`
+	Files          int64     `json:"files"`
+	Symlinks       int64     `json:"symlinks"`
+	FIFOs          int64     `json:"fifos"`
+	Sockets        int64     `json:"sockets"`
+	BytesRead      int64     `json:"bytes_read"`
+	BytesWritten   int64     `json:"bytes_written"`
+	Skipped        int64     `json:"skipped"`
+	Warnings       int64     `json:"warnings"`
+	Errors         int64     `json:"errors"`
+	HashMismatches int64     `json:"hash_mismatches"`
+	Elapsed        float64   `json:"elapsed_seconds"`
+	Throughput     float64   `json:"bytes_per_second"`
+	Failures       []failure `json:"failures,omitempty"`
+
+	start time.Time
+}
+
+// failure is an entry that could not be created or extracted.
+type failure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// startStats starts accumulating the statistics of the command.
+func startStats(command string) *runStats {
+	activeStats = &runStats{Command: command, start: time.Now()}
+	return activeStats
+}
+
+// encoded adds the counts from an Encoder, which read the contents of the
+// files it sent.
+func (rs *runStats) encoded(s saf.Stats) {
+	if rs != nil {
+		rs.add(s)
+		rs.BytesRead += s.Bytes
+	}
+}
+
+// decoded adds the counts from a Decoder, whose visitor wrote the contents of
+// the files it visited, unless it was a dry run.
+func (rs *runStats) decoded(s saf.Stats) {
+	if rs != nil {
+		rs.add(s)
+		if !*optDryRun {
+			rs.BytesWritten += s.Bytes
+		}
+	}
+}
+
+// copied adds the counts from a Copier, which both read and wrote the
+// contents of the files it copied.
+func (rs *runStats) copied(s saf.Stats) {
+	if rs != nil {
+		rs.add(s)
+		rs.BytesRead += s.Bytes
+		rs.BytesWritten += s.Bytes
+	}
+}
+
+func (rs *runStats) add(s saf.Stats) {
+	rs.Directories += s.Directories
+	rs.Files += s.Files
+	rs.Symlinks += s.Symlinks
+	rs.FIFOs += s.FIFOs
+	rs.Sockets += s.Sockets
+	rs.Skipped += s.Skipped
+	rs.HashMismatches += s.HashMismatches
+}
+
+// failed records an entry that could not be created or extracted, so it is
+// reported again when the run is finished.
+func (rs *runStats) failed(pathname string, err error) {
+	if rs != nil {
+		rs.Errors++
+		rs.Failures = append(rs.Failures, failure{Path: pathname, Error: err.Error()})
+	}
+}
+
+// finish prints the statistics, and writes them to the stats file when
+// requested. It returns err, which is counted as an error of the run, or the
+// error writing the stats file.
+func (rs *runStats) finish(err error) error {
+	if err != nil {
+		rs.Errors++
+	}
+	rs.Warnings = warnings
+	elapsed := time.Since(rs.start)
+	rs.Elapsed = elapsed.Seconds()
+	if rs.Elapsed > 0 {
+		rs.Throughput = float64(rs.BytesRead) / rs.Elapsed
+	}
+	if activeStats == rs {
+		activeStats = nil
+	}
+
+	if len(rs.Failures) > 0 && !logJSON {
+		// Failures were reported as they happened, but are easily missed
+		// among other messages.
+		logMessage("error", "[FAILED] ", "entries that failed: %d\n", len(rs.Failures))
+		for _, f := range rs.Failures {
+			pathname := f.Path
+			if pathname == "" {
+				pathname = "(entry could not be decoded)"
+			}
+			logMessage("error", "[FAILED] ", "%s: %s\n", pathname, f.Error)
+		}
+	}
+	if logJSON {
+		writeEvent(struct {
+			Time  time.Time `json:"time"`
+			Level string    `json:"level"`
+			Event string    `json:"event"`
+			*runStats
+		}{time.Now(), "info", "stats", rs})
+	} else {
+		logMessage("info", "[STATS] ", "%s: %d directories, %d files, %d symlinks, %d FIFOs, %d sockets; read %s, wrote %s in %s (%s/s); %d skipped, %d warnings, %d errors, %d hash mismatches\n",
+			rs.Command, rs.Directories, rs.Files, rs.Symlinks, rs.FIFOs, rs.Sockets,
+			formatBytes(float64(rs.BytesRead)), formatBytes(float64(rs.BytesWritten)), elapsed.Round(time.Millisecond), formatBytes(rs.Throughput),
+			rs.Skipped, rs.Warnings, rs.Errors, rs.HashMismatches)
+	}
+
+	if *optStatsFile != "" {
+		buf, err2 := json.Marshal(rs)
+		if err2 == nil {
+			err2 = ioutil.WriteFile(*optStatsFile, append(buf, '\n'), 0644)
+		}
+		if err == nil {
+			err = errors.Wrap(err2, "cannot write stats file")
+		}
+	}
+	return err
+}
+
+// countingFile counts the bytes read from the input file, whether read in
+// order or at random. It does not embed the file, so every read is counted.
+type countingFile struct {
+	f  *os.File
+	rs *runStats
+}
+
+func (cf *countingFile) Read(p []byte) (int, error) {
+	n, err := cf.f.Read(p)
+	cf.rs.BytesRead += int64(n)
+	return n, err
+}
+
+func (cf *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := cf.f.ReadAt(p, off)
+	cf.rs.BytesRead += int64(n)
+	return n, err
+}
+
+func (cf *countingFile) Stat() (os.FileInfo, error) { return cf.f.Stat() }
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w  io.Writer
+	rs *runStats
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.rs.BytesWritten += int64(n)
+	return n, err
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/karrick/tsync/saf"
+	"github.com/pkg/errors"
+)
+
+// importTar reads a tar archive from standard input and writes its entries
+// as a stream, using the same options as create.
+func importTar() error {
+	opts, err := encoderOptions()
+	if err != nil {
+		return err
+	}
+	if r := newProgressReporter(); r != nil {
+		opts.Progress = r.update
+		defer r.finish()
+	}
+
+	ti := &tarImporter{cr: &countingReader{r: os.Stdin}, files: make(map[string]tarFile)}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode().IsRegular() {
+		ti.ra = os.Stdin
+	}
+	ti.tr = tar.NewReader(ti.cr)
+	return createStream(opts, ti.encode)
+}
+
+// tarImporter converts a tar archive into a stream.
+type tarImporter struct {
+	tr *tar.Reader
+	cr *countingReader
+
+	// When the archive is a regular file, ra reads the contents of files
+	// that are the target of hard links, and files records where the
+	// contents of each regular file are in the archive.
+	ra    io.ReaderAt
+	files map[string]tarFile
+}
+
+// tarFile is a regular file in a tar archive.
+type tarFile struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+// countingReader counts the bytes read, so the offset of the contents of each
+// tar entry is known.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// encode adds each entry of the tar archive to the stream. Because tar
+// archives name each entry by its full path, the Encoder ascends and descends
+// directories as needed before each entry, and creates directories without
+// their own entry in the archive with default permissions. It returns an
+// error when the archive cannot be read, but only warns about entries it
+// cannot encode.
+func (ti *tarImporter) encode(e *saf.Encoder) error {
+	for {
+		hdr, err := ti.tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot read tar archive")
+		}
+
+		name := tarEntryName(hdr.Name)
+		if name == "" {
+			continue // archive root
+		}
+		if err = ti.encodeEntry(e, hdr, name); err != nil {
+			warning("%s: cannot import: %s\n", hdr.Name, err)
+			entryFailed(name, err)
+		}
+	}
+}
+
+// tarEntryName returns the cleaned name of the entry relative to the archive
+// root. Like tar, leading slashes are removed, and parent directory
+// components cannot refer outside of the archive root.
+func tarEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (ti *tarImporter) encodeEntry(e *saf.Encoder, hdr *tar.Header, name string) error {
+	debug("%s import %c\n", name, hdr.Typeflag)
+
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "SCHILY.xattr.") {
+			warning("%s: extended attributes are not imported\n", hdr.Name)
+			break
+		}
+	}
+
+	entry := &saf.Entry{
+		Path:    name,
+		Mode:    hdr.FileInfo().Mode(),
+		ModTime: hdr.ModTime,
+		UID:     uint32(hdr.Uid),
+		GID:     uint32(hdr.Gid),
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir, tar.TypeSymlink, tar.TypeFifo:
+		entry.Linkname = hdr.Linkname
+		return e.AddEntry(entry, nil)
+	case tar.TypeReg, tar.TypeRegA:
+		if ti.ra != nil {
+			ti.files[name] = tarFile{hdr: hdr, offset: ti.cr.n}
+		}
+		entry.Size = hdr.Size
+		return e.AddEntry(entry, ti.tr)
+	case tar.TypeLink:
+		// Streams do not have hard links, so each link is sent as a copy of
+		// the file it links to.
+		tf, ok := ti.files[tarEntryName(hdr.Linkname)]
+		if !ok {
+			if ti.ra == nil {
+				return errors.Errorf("cannot import hard link to %q unless archive is a regular file", hdr.Linkname)
+			}
+			return errors.Errorf("cannot import hard link to %q: target not found", hdr.Linkname)
+		}
+		entry.Mode = tf.hdr.FileInfo().Mode()
+		entry.ModTime = tf.hdr.ModTime
+		entry.UID, entry.GID = uint32(tf.hdr.Uid), uint32(tf.hdr.Gid)
+		entry.Size = tf.hdr.Size
+		return e.AddEntry(entry, io.NewSectionReader(ti.ra, tf.offset, tf.hdr.Size))
+	case tar.TypeChar, tar.TypeBlock:
+		return errors.New("devices are not supported")
+	case tar.TypeXGlobalHeader:
+		return nil
+	}
+	return errors.Errorf("tar entry type not supported: %q", hdr.Typeflag)
+}
+
+// exportTar reads a stream and writes its entries as a PAX tar archive to
+// standard output.
+func exportTar() error {
+	opts, err := decoderOptions()
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(os.Stdout)
+	err = decodeInput(opts, func(*saf.Decoder) saf.Visitor {
+		return tarWriter{tw}
+	})
+	if err2 := tw.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// tarModeBits maps file mode bits to the mode bits of a tar header.
+var tarModeBits = map[os.FileMode]int64{
+	os.ModeSetuid: 04000,
+	os.ModeSetgid: 02000,
+	os.ModeSticky: 01000,
+}
+
+// tarWriter is a visitor that writes each entry to a tar archive.
+type tarWriter struct {
+	tw *tar.Writer
+}
+
+func (tw tarWriter) Ascend(*saf.Entry) error { return nil }
+
+func (tw tarWriter) Visit(entry *saf.Entry, contents io.Reader) error {
+	name := newStreamEntry(entry, 0).Path
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(entry.Mode.Perm()),
+		Uid:     int(entry.UID),
+		Gid:     int(entry.GID),
+		ModTime: entry.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	for bit, tarBit := range tarModeBits {
+		if entry.Mode&bit != 0 {
+			hdr.Mode |= tarBit
+		}
+	}
+
+	switch typeString(entry.Mode) {
+	case "directory":
+		hdr.Typeflag = tar.TypeDir
+	case "file":
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = entry.Size
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = entry.Linkname
+	case "fifo":
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		warning("%s: cannot export %s to tar archive\n", name, typeString(entry.Mode))
+		return nil
+	}
+
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = time.Unix(0, 0)
+	}
+	// PAX records hold sub-second times, which streams do not have.
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+
+	// Verify contents before writing the header, so a corrupt file does not
+	// leave a truncated entry in the archive.
+	var buf []byte
+	if hdr.Typeflag == tar.TypeReg {
+		var err error
+		if buf, err = ioutil.ReadAll(contents); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "cannot write tar header: %s", name)
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		if _, err := tw.tw.Write(buf); err != nil {
+			return errors.Wrapf(err, "cannot write tar contents: %s", name)
+		}
+	}
+	return nil
+}
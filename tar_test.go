@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karrick/tsync/saf"
+)
+
+func TestTarEntryName(t *testing.T) {
+	cases := map[string]string{
+		"a/b":       "a/b",
+		"./a/b/":    "a/b",
+		"/a//b":     "a/b",
+		"a/../b":    "b",
+		".":         "",
+		"../a":      "a",
+		"a/b/../..": "",
+	}
+	for input, want := range cases {
+		if got := tarEntryName(input); got != want {
+			t.Errorf("%q: GOT: %q; WANT: %q", input, got, want)
+		}
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	long := strings.Repeat("x", 150)
+
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "top/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "top/" + long + "/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, Size: 5},
+		{Name: "top/link", Typeflag: tar.TypeSymlink, Linkname: "file", Mode: 0777, ModTime: mtime},
+		{Name: "other/file", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime, Size: 5},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := new(bytes.Buffer)
+	e, err := saf.NewEncoder(stream, saf.EncoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &tarImporter{tr: tar.NewReader(archive), cr: &countingReader{}, files: make(map[string]tarFile)}
+	if err = ti.encode(e); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := saf.NewDecoder(stream, saf.DecoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := new(bytes.Buffer)
+	tw = tar.NewWriter(exported)
+	if err = d.Decode(tarWriter{tw}); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(exported)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != "hello" {
+				t.Errorf("%s: GOT: %q; WANT: %q", hdr.Name, contents, "hello")
+			}
+		}
+	}
+
+	want := []string{"top/", "top/" + long + "/", "top/" + long + "/file", "top/link", "other/", "other/file"}
+	if got, want := strings.Join(names, ","), strings.Join(want, ","); got != want {
+		t.Errorf("GOT: %s; WANT: %s", got, want)
+	}
+}
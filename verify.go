@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/karrick/tsync/saf"
+	"github.com/pkg/errors"
+)
+
+// verify compares the entries in the stream against the file system relative
+// to the current working directory, without modifying the file system.
+func verify(args []string) error {
+	opts, err := decoderOptions()
+	if err != nil {
+		return err
+	}
+	v := &verifier{}
+	err = decodeInput(opts, func(d *saf.Decoder) saf.Visitor {
+		v.hash = d.Header().Hash
+		return v
+	})
+	if err == nil && v.differences > 0 {
+		err = errors.Errorf("%d differences", v.differences)
+	}
+	return err
+}
+
+// verifier is a visitor that reports the differences between the entries in
+// the stream and the file system.
+type verifier struct {
+	hash saf.HashAlgorithm
+
+	// seen is a stack holding the names of the entries received for each
+	// directory the stream has descended into, so entries in the destination
+	// that are not in the stream may be reported when ascending out of the
+	// directory.
+	seen []map[string]struct{}
+
+	// differences counts the missing, extra, and differing entries.
+	differences int
+}
+
+func (v *verifier) report(kind, pathname, detail string) {
+	v.differences++
+	if detail != "" {
+		fmt.Printf("%s: %s: %s\n", kind, pathname, detail)
+	} else {
+		fmt.Printf("%s: %s\n", kind, pathname)
+	}
+}
+
+func (v *verifier) Visit(entry *saf.Entry, _ io.Reader) error {
+	pathname := entry.Path
+	displayed := newStreamEntry(entry, v.hash).Path
+
+	// Record the name in its parent directory before descending.
+	if n := len(v.seen); n > 0 {
+		v.seen[n-1][entry.Name()] = struct{}{}
+	}
+	if entry.Mode.IsDir() {
+		v.seen = append(v.seen, make(map[string]struct{}))
+	}
+
+	fi, err := os.Lstat(filepath.FromSlash(pathname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			v.report("missing", displayed, "")
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	var differences []string
+	differ := func(format string, a ...interface{}) {
+		differences = append(differences, fmt.Sprintf(format, a...))
+	}
+
+	if got, want := fi.Mode()&os.ModeType, entry.Mode&os.ModeType; got != want {
+		differ("type %s != %s", typeString(got), typeString(want))
+	} else {
+		switch typeString(entry.Mode) {
+		case "file":
+			if got, want := fi.Size(), entry.Size; got != want {
+				differ("size %d != %d", got, want)
+			} else {
+				buf, err := ioutil.ReadFile(filepath.FromSlash(pathname))
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if got, want := v.hash.Sum(buf), entry.Hash; !bytes.Equal(got, want) {
+					differ("%s %x != %x", v.hash, got, want)
+				}
+			}
+			fallthrough
+		case "directory", "fifo":
+			if got, want := fi.Mode().Perm(), entry.Mode.Perm(); got != want {
+				differ("mode %04o != %04o", got, want)
+			}
+			if got, want := fi.ModTime().Unix(), entry.ModTime.Unix(); got != want {
+				differ("mtime %s != %s", fi.ModTime().Format("2006-01-02 15:04:05"), entry.ModTime.Format("2006-01-02 15:04:05"))
+			}
+		case "symlink":
+			// Modification time and mode of symbolic links are not restored
+			// by extract, so only the referent is compared.
+			linkname, err := os.Readlink(filepath.FromSlash(pathname))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if got, want := linkname, entry.Linkname; got != want {
+				differ("referent %q != %q", got, want)
+			}
+		}
+	}
+
+	if len(differences) > 0 {
+		v.report("differs", displayed, strings.Join(differences, "; "))
+	}
+	return nil
+}
+
+// Ascend reports entries in the directory being ascended out of that were not
+// in the stream.
+func (v *verifier) Ascend(dir *saf.Entry) error {
+	if len(v.seen) == 0 {
+		return nil
+	}
+	seen := v.seen[len(v.seen)-1]
+	v.seen = v.seen[:len(v.seen)-1]
+
+	dirname := filepath.FromSlash(dir.Path)
+	names, err := readDirnames(dirname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // already reported as missing
+		}
+		return errors.WithStack(err)
+	}
+	for _, name := range names {
+		if _, ok := seen[name]; !ok {
+			v.report("extra", filepath.ToSlash(filepath.Join(dirname, name)), "")
+		}
+	}
+	return nil
+}
+
+func readDirnames(dirname string) ([]string, error) {
+	fh, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	names, err := fh.Readdirnames(-1)
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	return names, err
+}
+
+func typeString(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeDir != 0:
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	case mode&os.ModeIrregular != 0:
+		return "unknown"
+	}
+	return "file"
+}
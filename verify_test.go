@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karrick/tsync/saf"
+)
+
+func TestVerify(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+
+	pathname := writeStream(t, []*saf.Entry{
+		{Path: "top", Mode: fs.ModeDir | 0755, ModTime: mtime},
+		{Path: "top/file", Mode: 0644, ModTime: mtime, Size: 5},
+	}, []string{"", "hello"})
+
+	// verifyTree creates a tree whose file has the contents, then verifies the
+	// stream against it.
+	verifyTree := func(t *testing.T, contents string) (string, error) {
+		t.Helper()
+		root := t.TempDir()
+		top := filepath.Join(root, "top")
+		if err := os.Mkdir(top, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(top, "file"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{filepath.Join(top, "file"), top} {
+			if err := os.Chtimes(name, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		wd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chdir(root); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := os.Chdir(wd); err != nil {
+				t.Fatal(err)
+			}
+		}()
+
+		withOptions(t, pathname, false)
+		return captureStdout(t, func() error { return verify(nil) })
+	}
+
+	t.Run("matches", func(t *testing.T) {
+		got, err := verifyTree(t, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "" {
+			t.Errorf("GOT: %q; WANT: %q", got, "")
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		got, err := verifyTree(t, "jello")
+		if err == nil {
+			t.Fatal("GOT: nil; WANT: error")
+		}
+		if want := "differs: top/file: xxhash64 "; !strings.HasPrefix(got, want) {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+}